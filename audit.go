@@ -0,0 +1,513 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	auditBkt     = "audit"
+	auditHeadKey = "head"
+
+	redactedValue = `"[redacted]"`
+)
+
+// AuditType is the type of an audit event.
+type AuditType string
+
+// AuditType values, the impersonation events are recorded by Auth.Impersonate and Auth.EndImpersonation.
+// Auth doesn't see the changes of the sessions and permissions packages, so their events are only in the log
+// if the caller records them with Auth.Audit: the log has no record of the ones it doesn't.
+const (
+	AuditLoginSuccess AuditType = "login"
+	AuditLoginFailure AuditType = "loginFailure"
+	AuditCreate       AuditType = "create"
+	AuditEdit         AuditType = "edit"
+	AuditDelete       AuditType = "delete"
+	AuditStatus       AuditType = "status"
+
+	AuditPermissionGrant  AuditType = "permissionGrant"
+	AuditPermissionRevoke AuditType = "permissionRevoke"
+	AuditSessionCreate    AuditType = "sessionCreate"
+	AuditSessionRevoke    AuditType = "sessionRevoke"
+
+	AuditImpersonateStart AuditType = "impersonateStart"
+	AuditImpersonateEnd   AuditType = "impersonateEnd"
+)
+
+// AuditEvent is an entry of the audit log, each event includes the hash of the previous one.
+type AuditEvent struct {
+	Seq  uint64    `json:"seq"`
+	Type AuditType `json:"type"`
+	// TS is the time of the event in unix nanoseconds.
+	TS int64 `json:"ts"`
+
+	// Actor is the ID of the user performing the action, it is empty for system or anonymous actions.
+	Actor string `json:"actor,omitempty"`
+	// Target is the ID of the user the action was performed on.
+	Target string `json:"target,omitempty"`
+
+	// Meta is client metadata, for example the ip and user agent.
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// Changes is the list of changed fields for AuditEdit and AuditStatus events.
+	Changes []AuditChange `json:"changes,omitempty"`
+
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash"`
+}
+
+// AuditChange is a changed field of a user, the values of the password and the encrypted profile fields are redacted.
+type AuditChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+// Time returns the time of the event.
+func (ev *AuditEvent) Time() time.Time { return time.Unix(0, ev.TS) }
+
+// computeHash returns the hash of the event chained to the previous one.
+func (ev AuditEvent) computeHash() string {
+	ev.Hash = ""
+	b, _ := json.Marshal(ev)
+	sum := sha256.Sum256(append([]byte(ev.Prev), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter is used to query the audit log, zero values match everything.
+type AuditFilter struct {
+	// UserID matches events where the user is the actor or the target.
+	UserID string
+
+	Since time.Time
+	Until time.Time
+
+	Types []AuditType
+}
+
+func (f *AuditFilter) match(ev *AuditEvent) bool {
+	if f.UserID != "" && ev.Actor != f.UserID && ev.Target != f.UserID {
+		return false
+	}
+
+	if !f.Since.IsZero() && ev.TS < f.Since.UnixNano() {
+		return false
+	}
+
+	if !f.Until.IsZero() && ev.TS >= f.Until.UnixNano() {
+		return false
+	}
+
+	if len(f.Types) == 0 {
+		return true
+	}
+
+	for _, t := range f.Types {
+		if t == ev.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auditInfo is who performed an action, see Auth.Actor.
+type auditInfo struct {
+	actor string
+	meta  map[string]string
+
+	// impersonator is the real user if actor is being impersonated, see Auth.Impersonate.
+	impersonator string
+}
+
+func (ai auditInfo) event(typ AuditType, target string) AuditEvent {
+	ev := AuditEvent{Type: typ, Target: target}
+	ai.fill(&ev)
+	return ev
+}
+
+// fill sets the actor of ev if it isn't set and merges the meta of ev into the actor's.
+// Events of impersonated actors are recorded as the impersonator's, with the "impersonating" meta key.
+func (ai auditInfo) fill(ev *AuditEvent) {
+	if ev.Actor == "" {
+		ev.Actor = ai.actor
+	}
+
+	if len(ai.meta) == 0 && ai.impersonator == "" {
+		return
+	}
+
+	meta := make(map[string]string, len(ai.meta)+len(ev.Meta)+1)
+	for k, v := range ai.meta {
+		meta[k] = v
+	}
+	for k, v := range ev.Meta {
+		meta[k] = v
+	}
+
+	if ai.impersonator != "" && ev.Actor == ai.actor {
+		ev.Actor = ai.impersonator
+		meta["impersonating"] = ai.actor
+	}
+
+	ev.Meta = meta
+}
+
+// Audit appends an event to the audit log, it is meant for events that happen outside of Auth,
+// like sessions and permissions changes. Seq, TS, Prev and Hash are set automatically.
+func (a *Auth) Audit(ev AuditEvent) error {
+	if !a.audit {
+		return ErrAuditDisabled
+	}
+
+	return a.record(ev)
+}
+
+// record appends ev to the audit log in its own transaction, it is a no-op if auditing is disabled.
+func (a *Auth) record(ev AuditEvent) error {
+	if !a.audit {
+		return nil
+	}
+
+	return a.update(func(tx turtleDB.Txn) error {
+		return a.appendAudit(tx, ev)
+	})
+}
+
+// appendAudit appends ev to the audit log as part of tx, it is a no-op if auditing is disabled.
+func (a *Auth) appendAudit(tx turtleDB.Txn, ev AuditEvent) error {
+	if !a.audit {
+		return nil
+	}
+
+	bkt, err := tx.Get(auditBkt)
+	if err != nil {
+		return err
+	}
+
+	head, err := getAuditEvent(bkt, auditHeadKey)
+	if err != nil && err != turtleDB.ErrKeyDoesNotExist {
+		return err
+	}
+
+	ev.Seq, ev.Prev = head.Seq+1, head.Hash
+	if ev.TS = time.Now().UnixNano(); ev.TS < head.TS {
+		// keep the log ordered even if the clock goes back
+		ev.TS = head.TS
+	}
+	ev.Hash = ev.computeHash()
+
+	if err = bkt.Put(strconv.FormatUint(ev.Seq, 10), ev); err != nil {
+		return err
+	}
+
+	return bkt.Put(auditHeadKey, ev)
+}
+
+// AuditLog returns the events matching the filter, oldest first.
+func (a *Auth) AuditLog(f AuditFilter) (evs []AuditEvent, err error) {
+	err = a.forEachAudit(func(ev *AuditEvent) error {
+		if f.match(ev) {
+			evs = append(evs, *ev)
+		}
+		return nil
+	})
+	return
+}
+
+// VerifyAudit checks the hash chain of the audit log, it returns the number of events checked.
+// If an event was modified, removed or inserted, the error wraps ErrAuditTampered with the first bad seq.
+// The chain has no key and its head isn't kept anywhere else, so removing the latest events along with
+// the head, or rewriting the whole chain, can't be detected: keep a copy of the latest hash elsewhere for that.
+func (a *Auth) VerifyAudit() (n int, err error) {
+	var prev AuditEvent
+	err = a.read(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(auditBkt)
+		if err != nil {
+			return err
+		}
+
+		head, err := getAuditEvent(bkt, auditHeadKey)
+		if err == turtleDB.ErrKeyDoesNotExist {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for seq := uint64(1); seq <= head.Seq; seq++ {
+			ev, err := getAuditEvent(bkt, strconv.FormatUint(seq, 10))
+			if err != nil || ev.Seq != seq || ev.Prev != prev.Hash || ev.Hash != ev.computeHash() {
+				return fmt.Errorf("%w: seq %d", ErrAuditTampered, seq)
+			}
+
+			prev = ev
+			n++
+		}
+
+		if prev.Hash != head.Hash {
+			return fmt.Errorf("%w: head", ErrAuditTampered)
+		}
+
+		return nil
+	})
+	return
+}
+
+func (a *Auth) forEachAudit(fn func(ev *AuditEvent) error) error {
+	return a.read(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(auditBkt)
+		if err != nil {
+			return err
+		}
+
+		head, err := getAuditEvent(bkt, auditHeadKey)
+		if err == turtleDB.ErrKeyDoesNotExist {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for seq := uint64(1); seq <= head.Seq; seq++ {
+			ev, err := getAuditEvent(bkt, strconv.FormatUint(seq, 10))
+			if err != nil {
+				return err
+			}
+
+			if err = fn(&ev); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// auditEdit records the changes between old and u, and a separate status event if the status changed or was set again.
+func (a *Auth) auditEdit(tx turtleDB.Txn, ai auditInfo, old, u *User) error {
+	if !a.audit {
+		return nil
+	}
+
+	changes, err := diffUsers(old, u)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	ev := ai.event(AuditEdit, u.ID)
+	ev.Changes = changes
+	if err = a.appendAudit(tx, ev); err != nil {
+		return err
+	}
+
+	if !statusChanged(old, u) {
+		return nil
+	}
+
+	ev = ai.event(AuditStatus, u.ID)
+	if n := len(u.StatusHistory); n > 0 && u.StatusHistory[n-1].Reason != "" {
+		meta := map[string]string{"reason": u.StatusHistory[n-1].Reason}
+		for k, v := range ev.Meta {
+			meta[k] = v
+		}
+		ev.Meta = meta
+	}
+
+	ev.Changes = []AuditChange{{
+		Field: "status",
+		Old:   json.RawMessage(strconv.Itoa(int(old.Status))),
+		New:   json.RawMessage(strconv.Itoa(int(u.Status))),
+	}}
+	return a.appendAudit(tx, ev)
+}
+
+// diffUsers returns the changed top-level fields of the users, profile fields are compared individually.
+func diffUsers(old, u *User) (changes []AuditChange, err error) {
+	var om, nm map[string]json.RawMessage
+	if om, err = rawFields(old); err != nil {
+		return
+	}
+
+	if nm, err = rawFields(u); err != nil {
+		return
+	}
+
+	// only the profile's own encrypted fields are redacted.
+	redacted := map[string]bool{"password": true, "passwordHistory": true}
+	for _, p := range []interface{}{old.Profile, u.Profile} {
+		specs, err := profileFieldSpecs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, spec := range specs {
+			redacted["profile."+spec.name] = true
+		}
+	}
+
+	delete(om, "lastUpdated")
+	delete(nm, "lastUpdated")
+
+	if op, np := om["profile"], nm["profile"]; !bytes.Equal(op, np) {
+		opm, oerr := rawFields(op)
+		npm, nerr := rawFields(np)
+		// a missing profile is compared as an empty one so encrypted fields are never diffed as a whole.
+		if oerr == nil && nerr == nil && (op == nil || opm != nil) && (np == nil || npm != nil) {
+			delete(om, "profile")
+			delete(nm, "profile")
+			for k, v := range opm {
+				om["profile."+k] = v
+			}
+			for k, v := range npm {
+				nm["profile."+k] = v
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(om)+len(nm))
+	for k := range om {
+		keys = append(keys, k)
+	}
+	for k := range nm {
+		if _, ok := om[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ov, nv := om[k], nm[k]
+		if bytes.Equal(ov, nv) {
+			continue
+		}
+
+		c := AuditChange{Field: k, Old: ov, New: nv}
+		if redacted[k] {
+			c.Old, c.New = nil, json.RawMessage(redactedValue)
+		}
+
+		changes = append(changes, c)
+	}
+
+	return
+}
+
+// rawFields returns the top-level json fields of v, it returns nil if v isn't a json object or null.
+func rawFields(v interface{}) (m map[string]json.RawMessage, err error) {
+	b, ok := v.(json.RawMessage)
+	if !ok {
+		if b, err = json.Marshal(v); err != nil {
+			return
+		}
+	}
+
+	if string(b) == "null" {
+		return map[string]json.RawMessage{}, nil
+	}
+
+	if len(b) == 0 || b[0] != '{' {
+		return nil, nil
+	}
+
+	err = json.Unmarshal(b, &m)
+	return
+}
+
+func getAuditEvent(bkt turtleDB.Bucket, key string) (ev AuditEvent, err error) {
+	var v turtleDB.Value
+	if v, err = bkt.Get(key); err != nil {
+		return
+	}
+
+	var ok bool
+	if ev, ok = v.(AuditEvent); !ok {
+		err = unexpectedTypeError(v)
+	}
+	return
+}
+
+func marshalAuditEvent(v turtleDB.Value) ([]byte, error) {
+	ev, ok := v.(AuditEvent)
+	if !ok {
+		return nil, unexpectedTypeError(v)
+	}
+	return json.Marshal(ev)
+}
+
+func unmarshalAuditEvent(b []byte) (turtleDB.Value, error) {
+	var ev AuditEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// Actor performs operations on behalf of a user, they are recorded in the audit log with the actor's ID
+// and client metadata. It is only useful if Options.Audit is enabled.
+type Actor struct {
+	a  *Auth
+	ai auditInfo
+}
+
+// Actor returns an Actor for the user id, id can be empty for anonymous actions like logging in.
+func (a *Auth) Actor(id string, meta map[string]string) *Actor {
+	return &Actor{a, auditInfo{actor: id, meta: meta}}
+}
+
+// CreateUser is Auth.CreateUser performed by the actor.
+func (ac *Actor) CreateUser(username, password string) (id string, err error) {
+	return ac.a.createUser(ac.ai, "", "", username, password)
+}
+
+// CreateUserWithID is Auth.CreateUserWithID performed by the actor.
+func (ac *Actor) CreateUserWithID(id string, username, password string) (uid string, err error) {
+	return ac.a.createUser(ac.ai, "", id, username, password)
+}
+
+// EditUserByID is Auth.EditUserByID performed by the actor.
+func (ac *Actor) EditUserByID(id string, fn func(u *User) error) error {
+	return ac.a.editUser(ac.ai, id, "", fn)
+}
+
+// EditUserByName is Auth.EditUserByName performed by the actor.
+func (ac *Actor) EditUserByName(username string, fn func(u *User) error) error {
+	if err := validUsername(username); err != nil {
+		return err
+	}
+
+	return ac.a.editUser(ac.ai, "", username, fn)
+}
+
+// DeleteUserByID is Auth.DeleteUserByID performed by the actor.
+func (ac *Actor) DeleteUserByID(id string) error {
+	return ac.a.deleteUser(ac.ai, id)
+}
+
+// Login is Auth.Login performed by the actor, the meta of login events usually holds the client ip and user agent.
+func (ac *Actor) Login(username, password string) (User, error) {
+	return ac.a.login(ac.ai, "", username, password)
+}
+
+// Audit is Auth.Audit with the actor's ID and metadata, ev.Meta is merged with the actor's.
+func (ac *Actor) Audit(ev AuditEvent) error {
+	ac.ai.fill(&ev)
+	return ac.a.Audit(ev)
+}
+
+// SetPassword is Auth.SetPassword performed by the actor.
+func (ac *Actor) SetPassword(id, password string) error {
+	return ac.a.setPassword(ac.ai, id, "", password)
+}
+
+// Impersonator returns the ID of the real user if the actor is being impersonated.
+func (ac *Actor) Impersonator() string {
+	return ac.ai.impersonator
+}
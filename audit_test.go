@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+func TestAudit(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	path := filepath.Join(tmpPath, "db")
+	a, err := NewTypedWithOptions[piiProfile](path, Options{
+		Audit:    true,
+		FieldKey: []byte("0123456789abcdef0123456789abcdef"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := a.CreateUser("admin", "slimer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		start = time.Now()
+		ac    = a.Actor(admin, map[string]string{"ip": "127.0.0.1"})
+	)
+
+	id, err := ac.CreateUser("ray", "ecto-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ac.EditUserByID(id, func(u *User) error {
+		u.Status = StatusActive
+		u.Profile = piiProfile{Name: "Ray", Email: "ray@gb.com"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Actor("", map[string]string{"ip": "10.0.0.1"}).Login("ray", "wrong"); err != ErrInvalidLogin {
+		t.Fatalf("expected ErrInvalidLogin, got %v", err)
+	}
+
+	if _, err = a.Login("ray", "ecto-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ac.Audit(AuditEvent{Type: AuditSessionRevoke, Target: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	evs, err := a.AuditLog(AuditFilter{UserID: id, Since: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []AuditType{AuditCreate, AuditEdit, AuditStatus, AuditLoginFailure, AuditLoginSuccess, AuditSessionRevoke}
+	if len(evs) != len(exp) {
+		t.Fatalf("expected %d events, got %+v", len(exp), evs)
+	}
+
+	for i, ev := range evs {
+		if ev.Type != exp[i] {
+			t.Fatalf("event %d: expected %s, got %s", i, exp[i], ev.Type)
+		}
+	}
+
+	if evs[0].Actor != admin || evs[0].Meta["ip"] != "127.0.0.1" {
+		t.Fatalf("unexpected actor: %+v", evs[0])
+	}
+
+	if evs[3].Meta["ip"] != "10.0.0.1" || evs[3].Meta["username"] != "ray" {
+		t.Fatalf("unexpected login failure meta: %+v", evs[3].Meta)
+	}
+
+	changes := map[string]AuditChange{}
+	for _, c := range evs[1].Changes {
+		changes[c.Field] = c
+	}
+
+	if c := changes["profile.name"]; string(c.New) != `"Ray"` {
+		t.Fatalf("unexpected profile.name change: %+v", c)
+	}
+
+	if c := changes["profile.email"]; c.Old != nil || string(c.New) != redactedValue {
+		t.Fatalf("encrypted field wasn't redacted: %+v", c)
+	}
+
+	if evs, _ = a.AuditLog(AuditFilter{Types: []AuditType{AuditStatus}, Until: start}); len(evs) != 0 {
+		t.Fatalf("expected no events, got %+v", evs)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewTypedWithOptions[piiProfile](path, Options{
+		Audit:    true,
+		FieldKey: []byte("0123456789abcdef0123456789abcdef"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	n, err := a.VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 7 {
+		t.Fatalf("expected 7 events, got %d", n)
+	}
+
+	if err = a.update(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(auditBkt)
+		if err != nil {
+			return err
+		}
+
+		ev, err := getAuditEvent(bkt, "3")
+		if err != nil {
+			return err
+		}
+
+		ev.Actor = ""
+		return bkt.Put("3", ev)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.VerifyAudit(); !errors.Is(err, ErrAuditTampered) {
+		t.Fatalf("expected ErrAuditTampered, got %v", err)
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := New(tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if _, err = a.CreateUser("winston", "zeddemore"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Audit(AuditEvent{Type: AuditSessionCreate}); !errors.Is(err, ErrAuditDisabled) {
+		t.Fatalf("expected ErrAuditDisabled, got %v", err)
+	}
+
+	if evs, err := a.AuditLog(AuditFilter{}); err != nil || len(evs) != 0 {
+		t.Fatalf("expected an empty log, got %v %v", evs, err)
+	}
+}
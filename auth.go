@@ -3,6 +3,8 @@ package auth
 import (
 	"encoding/json"
 	"math/big"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,17 +14,73 @@ import (
 )
 
 var (
-	buckets = &[...]string{"users", "logins", "tokens", "index"}
+	buckets = &[...]string{"users", "logins", "tokens", "index", blindBkt, auditBkt, outboxBkt, outboxDeadBkt, invitesBkt}
 
 	one = big.NewInt(1)
 )
 
 // Auth is a generic user authentication helper.
 type Auth struct {
-	t *turtleDB.Turtle
+	// mux guards t, which is replaced when the encryption key is rotated.
+	mux sync.RWMutex
+	t   *turtleDB.Turtle
+
+	path string
+	key  Key
 
 	//ProfileFn is used on loading users from the database to fill in the User.Profile field.}
 	profileFn atomic.Value
+
+	migrations *Migrations
+	fields     *fieldCrypter
+	audit      bool
+
+	hooks  hooks
+	outbox *outbox
+
+	passwordPolicy PasswordPolicy
+}
+
+// Options are the optional settings used by NewWithOptions.
+type Options struct {
+	// Key and IV are used to encrypt the store, if Key is nil the store is not encrypted.
+	Key, IV []byte
+
+	// Keyring holds other keys the store may be encrypted with, for example after an interrupted RotateKey.
+	// The key the store is actually encrypted with is picked on open, see RotateKey.
+	Keyring []Key
+
+	// ProfileFn is used on loading users from the database to fill in the User.Profile field,
+	// unlike Auth.NewProfileFn it is set before the database is loaded.
+	ProfileFn func() interface{}
+
+	// Migrations are applied to stored users older than the current schema version.
+	// It must not be modified after it is passed to NewWithOptions.
+	Migrations *Migrations
+
+	// FieldKey enables the encryption of profile fields tagged with `auth:"encrypt"`, each user's fields
+	// are encrypted with AES-GCM using their own data key, which is in turn encrypted with FieldKey.
+	// Fields tagged with `auth:"encrypt,index"` can be looked up with Auth.LookupByField.
+	// Only top-level string fields of struct profiles are supported and Export writes them in plain-text.
+	FieldKey []byte
+
+	// FieldKeysPath is where the data keys are stored, it defaults to path + ".fieldkeys".
+	// It should be kept out of the backups of path so Auth.ShredUser also covers them.
+	FieldKeysPath string
+
+	// Audit enables the audit log, see Auth.AuditLog and Auth.Actor.
+	// The sessions and permissions events are up to the caller, see Auth.Audit.
+	Audit bool
+
+	// Outbox enables the transactional outbox, every user change is written to the outbox in the same
+	// transaction as the change and delivered to Outbox.Sink by a background dispatcher.
+	// Imports, the password rehash on login, Auth.MigrateAll and Auth.ReindexFields don't write to the outbox:
+	// imports are restores of other stores, and the others only rewrite the password hash, the schema version
+	// or the blind indexes of unchanged users.
+	Outbox *OutboxOptions
+
+	// PasswordPolicy sets the password max age and history size, the zero value disables both.
+	PasswordPolicy PasswordPolicy
 }
 
 // New returns a new Auth db at the specificed path.
@@ -33,21 +91,47 @@ func New(path string) (*Auth, error) {
 // NewEncrypted returns a new Auth db that is encrypted with the specified key/iv.
 // if key is nil, it returns a non-encrypted store.
 func NewEncrypted(path string, key, iv []byte) (*Auth, error) {
+	return NewWithOptions(path, Options{Key: key, IV: iv})
+}
+
+// NewWithOptions returns a new Auth db at the specified path using the provided options.
+func NewWithOptions(path string, opts Options) (*Auth, error) {
 	var (
-		a       Auth
-		funcMap = turtleDB.NewFuncsMap(turtleDB.MarshalJSON, turtleDB.UnmarshalJSON)
-		err     error
+		a   Auth
+		err error
 	)
 
-	funcMap.Put("users", marshalUser, a.unmarshalUser)
+	if opts.ProfileFn != nil {
+		a.NewProfileFn(opts.ProfileFn)
+	}
+
+	a.path = path
+	a.migrations = opts.Migrations
+	a.audit = opts.Audit
+	a.passwordPolicy = opts.PasswordPolicy
+
+	if err = recoverRotation(path); err != nil {
+		return nil, err
+	}
+
+	if opts.FieldKey != nil {
+		if opts.FieldKeysPath == "" {
+			opts.FieldKeysPath = path + fieldKeysSuffix
+		}
+
+		if a.fields, err = newFieldCrypter(opts.FieldKey, opts.FieldKeysPath); err != nil {
+			return nil, err
+		}
+	}
 
-	if key != nil {
-		a.t, err = turtleDB.New("auth", path, funcMap, middleware.NewCryptyMW(key, iv))
-	} else {
-		a.t, err = turtleDB.New("auth", path, funcMap)
+	if a.key, err = selectKey(path, append([]Key{{opts.Key, opts.IV}}, opts.Keyring...), a.probeKey(path)); err == nil {
+		a.t, err = a.open(path, a.key)
 	}
 
 	if err != nil {
+		if a.fields != nil {
+			a.fields.close()
+		}
 		return nil, err
 	}
 
@@ -58,13 +142,54 @@ func NewEncrypted(path string, key, iv []byte) (*Auth, error) {
 			}
 		}
 		return nil
-	}); err != nil {
+	}); err == nil {
+		err = writeKeyCheck(path, a.key)
+	}
+
+	if err != nil {
+		a.Close()
 		return nil, err
 	}
 
+	if opts.Outbox != nil {
+		a.outbox = newOutbox(&a, *opts.Outbox)
+		a.outbox.start()
+	}
+
 	return &a, nil
 }
 
+// open opens the turtleDB at path, encrypted with k if k.Key isn't nil.
+func (a *Auth) open(path string, k Key) (*turtleDB.Turtle, error) {
+	funcMap := turtleDB.NewFuncsMap(turtleDB.MarshalJSON, turtleDB.UnmarshalJSON)
+	funcMap.Put("users", a.marshalUser, a.unmarshalUser)
+	funcMap.Put(blindBkt, marshalBlindIDs, unmarshalBlindIDs)
+	funcMap.Put(auditBkt, marshalAuditEvent, unmarshalAuditEvent)
+	funcMap.Put(outboxBkt, marshalOutboxEvent, unmarshalOutboxEvent)
+	funcMap.Put(outboxDeadBkt, marshalOutboxEvent, unmarshalOutboxEvent)
+	funcMap.Put(invitesBkt, marshalInviteCode, unmarshalInviteCode)
+
+	if k.Key != nil {
+		return turtleDB.New("auth", path, funcMap, middleware.NewCryptyMW(k.Key, k.IV))
+	}
+
+	return turtleDB.New("auth", path, funcMap)
+}
+
+// read runs fn in a read transaction.
+func (a *Auth) read(fn func(tx turtleDB.Txn) error) error {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.t.Read(fn)
+}
+
+// update runs fn in a write transaction.
+func (a *Auth) update(fn func(tx turtleDB.Txn) error) error {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.t.Update(fn)
+}
+
 // NewProfileFn is used on loading users from the database to fill in the User.Profile field.
 // it is 100% optional
 func (a *Auth) NewProfileFn(fn func() interface{}) {
@@ -79,24 +204,35 @@ func (a *Auth) getProfileFn() func() interface{} {
 // CreateUser will add the passed user to the database and hash the given password.
 // the passed user will be modified with the hashed password and the new ID.
 func (a *Auth) CreateUser(username, password string) (id string, err error) {
-	return a.createUser("", username, password)
+	return a.createUser(auditInfo{}, "", "", username, password)
 }
 
 // CreateUserWithID will add the passed user to the database and hash the given password as the provided ID
 func (a *Auth) CreateUserWithID(id string, username, password string) (uid string, err error) {
-	return a.createUser(id, username, password)
+	return a.createUser(auditInfo{}, "", id, username, password)
 }
 
 // createUser will add the passed user to the database and hash the given password.
 // the passed user will be modified with the hashed password and the new ID.
-func (a *Auth) createUser(id string, username, password string) (uid string, err error) {
-	var u User
+// id is the tenant's part of the ID, see Tenant.
+func (a *Auth) createUser(ai auditInfo, tenant, id string, username, password string) (uid string, err error) {
+	return a.createUserTx(ai, tenant, id, username, password, nil)
+}
+
+// createUserTx is createUser with fn, if not nil, called in the same transaction once the user has its ID.
+func (a *Auth) createUserTx(ai auditInfo, tenant, id string, username, password string, fn func(tx turtleDB.Txn, u *User) error) (uid string, err error) {
+	var (
+		u   User
+		evs []HookEvent
+	)
 	// hash outside the db lock
 	if u.Password, err = HashPassword(password); err != nil {
 		return
 	}
 
 	u.Status = StatusInactive
+	u.SchemaVersion = a.migrations.Version()
+	u.TenantID = tenant
 	u.Username = username
 	u.CreatedTS = time.Now().Unix()
 	u.LastUpdatedTS = u.CreatedTS
@@ -105,62 +241,253 @@ func (a *Auth) createUser(id string, username, password string) (uid string, err
 		return
 	}
 
-	if err = a.t.Update(func(tx turtleDB.Txn) error {
+	if id != "" {
+		u.ID = tenantUserID(tenant, id)
+	}
+
+	// the hooks run outside the db lock, the generated IDs aren't known yet
+	if err = a.hooks.runBefore(hookEvents(HookCreate, ai, nil, &u)); err != nil {
+		return
+	}
+
+	if err = a.update(func(tx turtleDB.Txn) error {
 		var (
 			loginsB, _ = tx.Get("logins")
 			usersB, _  = tx.Get("users")
 		)
 
 		if len(id) == 0 {
-			if id, _ = GetUserIDTx(tx, u.Username); id != "" {
+			if id, _ = GetUserIDTx(tx, loginKey(tenant, u.Username)); id != "" {
 				return ErrUserExists
 			}
 
-			if u.ID, err = a.nextID(tx, "users"); err != nil {
+			if id, err = a.nextID(tx, tenantCounter(tenant)); err != nil {
 				return err
 			}
-		} else {
-			if err = a.setID(tx, "users", id); err != nil {
+		} else if err = a.setID(tx, tenantCounter(tenant), id); err != nil {
+			return err
+		}
+
+		u.ID = tenantUserID(tenant, id)
+
+		if fn != nil {
+			if err = fn(tx, &u); err != nil {
 				return err
 			}
-
-			u.ID = id
 		}
 
 		if err = usersB.Put(u.ID, u); err != nil {
 			return err
 		}
 
-		return loginsB.Put(u.Username, u.ID)
+		if err = loginsB.Put(loginKey(tenant, u.Username), u.ID); err != nil {
+			return err
+		}
+
+		evs = hookEvents(HookCreate, ai, nil, &u)
+		if err = a.appendOutbox(tx, evs); err != nil {
+			return err
+		}
+
+		return a.appendAudit(tx, ai.event(AuditCreate, u.ID))
 	}); err != nil {
 		return
 	}
 
+	a.outbox.notify()
+	a.hooks.runAfter(evs)
 	uid = u.ID
 	return
 }
 
 // EditUserByID edits a user by their ID, returning an error will cancel the edit.
+// fn edits a copy of the user, it is called again if the user changes before the edit is committed.
 func (a *Auth) EditUserByID(id string, fn func(u *User) error) error {
-	return a.t.Update(func(tx turtleDB.Txn) error {
-		return EditUserTx(tx, id, fn)
-	})
+	return a.editUser(auditInfo{}, id, "", fn)
 }
 
-// EditUserByName edits a user by their username, returning an error will cancel the edit.
+// EditUserByName edits a user by their username, returning an error will cancel the edit, see EditUserByID.
 func (a *Auth) EditUserByName(username string, fn func(u *User) error) error {
-	return a.t.Update(func(tx turtleDB.Txn) error {
-		id, err := GetUserIDTx(tx, username)
+	if err := validUsername(username); err != nil {
+		return err
+	}
+
+	return a.editUser(auditInfo{}, "", username, fn)
+}
+
+// editUser edits a user by id, or by login if id is empty, and runs the after hooks once it is committed.
+// login is the tenant qualified username, see loginKey.
+func (a *Auth) editUser(ai auditInfo, id, login string, fn func(u *User) error) error {
+	for {
+		var old User
+		if err := a.read(func(tx turtleDB.Txn) (err error) {
+			if id == "" {
+				if id, err = GetUserIDTx(tx, login); err != nil {
+					return
+				}
+			}
+
+			old, err = GetUserByIDTx(tx, id)
+			return
+		}); err != nil {
+			return err
+		}
+
+		u, err := a.prepareEdit(ai, &old, fn)
 		if err != nil {
 			return err
 		}
-		return EditUserTx(tx, id, fn)
-	})
+
+		var evs []HookEvent
+		if err = a.update(func(tx turtleDB.Txn) (err error) {
+			evs, err = a.commitEdit(tx, ai, &old, u)
+			return
+		}); err == errUserChanged {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		a.outbox.notify()
+		a.hooks.runAfter(evs)
+		return nil
+	}
+}
+
+// prepareEdit applies fn to a copy of old and runs the before hooks, outside of the db lock.
+func (a *Auth) prepareEdit(ai auditInfo, old *User, fn func(u *User) error) (u *User, err error) {
+	u = copyUser(old)
+	if err = fn(u); err != nil {
+		return nil, err
+	}
+
+	if ai.impersonator != "" && (u.Password != old.Password || u.Username != old.Username) {
+		return nil, ErrImpersonating
+	}
+
+	if err = applyStatusChange(ai, old, u); err != nil {
+		return nil, err
+	}
+
+	a.applyPasswordChange(old, u)
+
+	if err = a.hooks.runBefore(hookEvents(HookEdit, ai, old, u)); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// commitEdit writes u, prepared from old by prepareEdit, and keeps the blind indexes and the audit log up to date.
+// It returns errUserChanged if the stored user isn't old anymore, and the events for the after hooks otherwise.
+func (a *Auth) commitEdit(tx turtleDB.Txn, ai auditInfo, old, u *User) (evs []HookEvent, err error) {
+	var cur User
+	if cur, err = GetUserByIDTx(tx, old.ID); err != nil {
+		return
+	}
+
+	if !reflect.DeepEqual(&cur, old) {
+		return nil, errUserChanged
+	}
+
+	if err = EditUserTx(tx, old.ID, func(eu *User) error {
+		*eu = *u
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if cur, err = GetUserByIDTx(tx, old.ID); err != nil {
+		return nil, err
+	}
+
+	if a.fields != nil {
+		if err = a.fields.reindex(tx, old, &cur); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = a.auditEdit(tx, ai, old, &cur); err != nil {
+		return nil, err
+	}
+
+	// cur has the timestamps set by the store
+	evs = hookEvents(HookEdit, ai, old, &cur)
+	if err = a.appendOutbox(tx, evs); err != nil {
+		return nil, err
+	}
+
+	return evs, nil
+}
+
+// DeleteUserByID deletes a user, if field encryption is enabled the user's data key is deleted as well.
+func (a *Auth) DeleteUserByID(id string) error {
+	return a.deleteUser(auditInfo{}, id)
+}
+
+func (a *Auth) deleteUser(ai auditInfo, id string) (err error) {
+	for {
+		var u User
+		if u, err = a.GetUserByID(id); err != nil {
+			return
+		}
+
+		evs := hookEvents(HookDelete, ai, &u, nil)
+		if err = a.hooks.runBefore(evs); err != nil {
+			return
+		}
+
+		if err = a.update(func(tx turtleDB.Txn) error {
+			var (
+				usersB, _  = tx.Get("users")
+				loginsB, _ = tx.Get("logins")
+			)
+
+			cur, err := GetUserByIDTx(tx, id)
+			if err != nil {
+				return err
+			}
+
+			if !reflect.DeepEqual(cur, u) {
+				return errUserChanged
+			}
+
+			if err = a.unindexUser(tx, &u); err != nil {
+				return err
+			}
+
+			if err = usersB.Delete(id); err != nil {
+				return err
+			}
+
+			if err = loginsB.Delete(loginKey(u.TenantID, u.Username)); err != nil {
+				return err
+			}
+
+			if err = a.appendOutbox(tx, evs); err != nil {
+				return err
+			}
+
+			return a.appendAudit(tx, ai.event(AuditDelete, id))
+		}); err == errUserChanged {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		if a.fields != nil {
+			err = a.fields.shred(id)
+		}
+
+		a.outbox.notify()
+		a.hooks.runAfter(evs)
+		return
+	}
 }
 
 // GetUserByID returns a User by their ID.
 func (a *Auth) GetUserByID(id string) (u User, err error) {
-	err = a.t.Read(func(tx turtleDB.Txn) error {
+	err = a.read(func(tx turtleDB.Txn) error {
 		u, err = GetUserByIDTx(tx, id)
 		return err
 	})
@@ -169,16 +496,145 @@ func (a *Auth) GetUserByID(id string) (u User, err error) {
 
 // GetUserByName returns a User by their UserName.
 func (a *Auth) GetUserByName(username string) (u User, err error) {
-	err = a.t.Read(func(tx turtleDB.Txn) error {
-		u, err = GetUserByNameTx(tx, username)
+	return a.getUserByName("", username)
+}
+
+// getUserByName returns a User of a tenant by their UserName.
+func (a *Auth) getUserByName(tenant, username string) (u User, err error) {
+	if err = validUsername(username); err != nil {
+		return
+	}
+
+	err = a.read(func(tx turtleDB.Txn) error {
+		u, err = GetUserByNameTx(tx, loginKey(tenant, username))
 		return err
 	})
 	return
 }
 
+// Login returns the User if the username and password match, otherwise it returns ErrInvalidLogin.
+// Banned, suspended and deleted users get ErrBadStatus, an expired suspension is ended first.
+// Expired accounts get ErrAccountExpired and expired passwords get ErrPasswordExpired,
+// in which case the user has to use Auth.ChangePassword before logging in.
+// A password stored with a foreign or weaker hash is rehashed with bcrypt on a successful login.
+func (a *Auth) Login(username, password string) (u User, err error) {
+	return a.login(auditInfo{}, "", username, password)
+}
+
+func (a *Auth) login(ai auditInfo, tenant, username, password string) (u User, err error) {
+	if u, err = a.getUserByName(tenant, username); err != nil {
+		a.auditLogin(ai, AuditLoginFailure, "", username)
+		return User{}, ErrInvalidLogin
+	}
+
+	if !u.PasswordsMatch(password) {
+		a.auditLogin(ai, AuditLoginFailure, u.ID, username)
+		return User{}, ErrInvalidLogin
+	}
+
+	switch err = a.checkStatus(&u); err {
+	case nil:
+	case ErrBadStatus, ErrAccountExpired:
+		a.auditLogin(ai, AuditLoginFailure, u.ID, username)
+		return User{}, err
+	default:
+		return User{}, err
+	}
+
+	if t := u.PasswordExpires(a.passwordPolicy.MaxAge); !t.IsZero() && !t.After(time.Now()) {
+		a.auditLogin(ai, AuditLoginFailure, u.ID, username)
+		return User{}, ErrPasswordExpired
+	}
+
+	if err = a.hooks.runBefore(hookEvents(HookLogin, ai, nil, &u)); err != nil {
+		a.auditLogin(ai, AuditLoginFailure, u.ID, username)
+		return User{}, err
+	}
+
+	if err = a.auditLogin(ai, AuditLoginSuccess, u.ID, username); err != nil {
+		return User{}, err
+	}
+
+	defer func() {
+		if err == nil {
+			a.hooks.runAfter(hookEvents(HookLogin, ai, nil, &u))
+		}
+	}()
+
+	if !NeedsRehash(u.Password) {
+		return
+	}
+
+	// hash outside the db lock
+	var (
+		oldHash = u.Password
+		hash    string
+	)
+
+	if hash, err = HashPassword(password); err != nil {
+		return
+	}
+
+	// the login itself succeeded, if the rehash fails it will be retried on the next login.
+	// it isn't an edit made by anyone, so it goes around editUser.
+	var nu User
+	if a.update(func(tx turtleDB.Txn) error {
+		return EditUserTx(tx, u.ID, func(eu *User) error {
+			if eu.Password != oldHash {
+				// changed since we read it
+				return nil
+			}
+
+			eu.Password, eu.PasswordImported = hash, false
+			nu = *eu
+			return nil
+		})
+	}) == nil && nu.ID != "" {
+		u = nu
+	}
+
+	return
+}
+
+// checkStatus lifts the expired suspension of u, then returns ErrBadStatus or ErrAccountExpired
+// if u can't log in.
+func (a *Auth) checkStatus(u *User) (err error) {
+	if u.Status == StatusSuspended && u.StatusExpired() {
+		if err = a.editUser(auditInfo{}, u.ID, "", expireStatus); err == nil {
+			*u, err = a.GetUserByID(u.ID)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	switch u.Status {
+	case StatusBanned, StatusSuspended, StatusPendingDeletion, StatusDeleted:
+		return ErrBadStatus
+	}
+
+	if u.AccountExpired() {
+		return ErrAccountExpired
+	}
+
+	return nil
+}
+
+// auditLogin records a login attempt, target is empty if the user doesn't exist.
+func (a *Auth) auditLogin(ai auditInfo, typ AuditType, target, username string) error {
+	if !a.audit {
+		return nil
+	}
+
+	ev := AuditEvent{Type: typ, Target: target, Meta: map[string]string{"username": username}}
+	ai.fill(&ev)
+	return a.record(ev)
+}
+
 // ForEach will iterate through each of the users
 func (a *Auth) ForEach(fn func(User) error) (err error) {
-	return a.t.Read(func(txn turtleDB.Txn) (err error) {
+	return a.read(func(txn turtleDB.Txn) (err error) {
 		var bkt turtleDB.Bucket
 		if bkt, err = txn.Get("users"); err != nil {
 			return
@@ -201,22 +657,63 @@ func (a *Auth) ForEach(fn func(User) error) (err error) {
 
 // Close closes the underlying database.
 func (a *Auth) Close() error {
+	if a.outbox != nil {
+		// stop the dispatcher before taking the lock, it may be waiting for it.
+		a.outbox.stop()
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.fields != nil {
+		if err := a.fields.close(); err != nil {
+			a.t.Close()
+			return err
+		}
+	}
+
 	return a.t.Close()
 }
 
+// marshalUser is a helper for turtleDB, it encrypts the profile fields if field encryption is enabled.
+func (a *Auth) marshalUser(v turtleDB.Value) ([]byte, error) {
+	b, err := marshalUser(v)
+	if err != nil || a.fields == nil {
+		return b, err
+	}
+
+	u := v.(User)
+	return a.fields.encrypt(&u, b)
+}
+
 // unmarshalUser is a helper for turtleDB.
 func (a *Auth) unmarshalUser(p []byte) (turtleDB.Value, error) {
-	var u User
+	u, err := a.decodeUser(p, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// decodeUser migrates and decodes the json of a user, decrypt is false for plain-text json like the output of Export.
+func (a *Auth) decodeUser(p []byte, decrypt bool) (u User, err error) {
+	if p, err = a.migrations.migrate(p); err != nil {
+		return
+	}
 
 	if pfn := a.getProfileFn(); pfn != nil {
 		u.Profile = pfn()
 	}
 
-	if err := json.Unmarshal(p, &u); err != nil {
-		return nil, err
+	if decrypt && a.fields != nil {
+		if p, err = a.fields.decrypt(p, u.Profile); err != nil {
+			return
+		}
 	}
 
-	return u, nil
+	err = json.Unmarshal(p, &u)
+	return
 }
 
 func (a *Auth) nextID(tx turtleDB.Txn, bucket string) (string, error) {
@@ -0,0 +1,314 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Foreign hash formats, these are only verified, new passwords are always hashed with bcrypt.
+const (
+	apr1Prefix   = "$apr1$"
+	md5Prefix    = "$1$"
+	sha256Prefix = "$5$"
+	sha512Prefix = "$6$"
+	sha1Prefix   = "{SHA}"
+
+	roundsPrefix = "rounds="
+
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	// shaCryptMaxRounds is lower than the 999999999 of the spec, a crafted hash could otherwise
+	// keep a login busy for minutes. It is well above the defaults of the systems which set rounds.
+	shaCryptMaxRounds = 1000000
+)
+
+// crypt(3) uses its own base64 alphabet and byte order.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	md5CryptOrder = [...][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+
+	sha256CryptOrder = [...][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+
+	sha512CryptOrder = [...][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// IsForeignHash checks if hash is one of the non-bcrypt formats supported by CheckPassword:
+// APR1-MD5 and MD5-crypt, SHA-256/SHA-512 crypt and htpasswd's {SHA}.
+func IsForeignHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, apr1Prefix), strings.HasPrefix(hash, md5Prefix):
+		return strings.Count(hash, "$") >= 3
+	case strings.HasPrefix(hash, sha256Prefix), strings.HasPrefix(hash, sha512Prefix):
+		_, _, ok := shaCryptRounds(hash[len(sha256Prefix):])
+		return ok && strings.Count(hash, "$") >= 3
+	case strings.HasPrefix(hash, sha1Prefix):
+		b, err := base64.StdEncoding.DecodeString(hash[len(sha1Prefix):])
+		return err == nil && len(b) == sha1.Size
+	default:
+		return false
+	}
+}
+
+// checkForeignPassword checks a foreign hashed password against a plain-text password.
+func checkForeignPassword(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, apr1Prefix):
+		computed = md5Crypt(password, hash, apr1Prefix)
+	case strings.HasPrefix(hash, md5Prefix):
+		computed = md5Crypt(password, hash, md5Prefix)
+	case strings.HasPrefix(hash, sha256Prefix):
+		computed = shaCrypt(sha256.New, sha256Prefix, sha256CryptOrder[:], password, hash)
+	case strings.HasPrefix(hash, sha512Prefix):
+		computed = shaCrypt(sha512.New, sha512Prefix, sha512CryptOrder[:], password, hash)
+	case strings.HasPrefix(hash, sha1Prefix):
+		sum := sha1.Sum([]byte(password))
+		computed = sha1Prefix + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+
+	return computed != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// cryptSalt returns the salt part of a crypt(3) string, setting stops at the first '$'.
+func cryptSalt(s string, max int) string {
+	if i := strings.IndexByte(s, '$'); i != -1 {
+		s = s[:i]
+	}
+
+	if len(s) > max {
+		s = s[:max]
+	}
+
+	return s
+}
+
+// md5Crypt implements the FreeBSD MD5-crypt algorithm, also used by Apache as APR1.
+func md5Crypt(password, hash, magic string) string {
+	var (
+		pw   = []byte(password)
+		salt = []byte(cryptSalt(hash[len(magic):], 8))
+	)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(salt)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write(salt)
+	for i := len(pw); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			d.Write(altSum)
+		} else {
+			d.Write(altSum[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+
+	final := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+
+		if i%3 != 0 {
+			d.Write(salt)
+		}
+
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+
+		final = d.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	for _, o := range md5CryptOrder {
+		out = cryptEncode(out, final[o[0]], final[o[1]], final[o[2]], 4)
+	}
+	out = cryptEncode(out, 0, 0, final[11], 2)
+
+	return magic + string(salt) + "$" + string(out)
+}
+
+// shaCryptRounds parses the optional rounds of a SHA-crypt string without its magic, rest is the remaining salt and hash.
+// Rounds below the minimum are raised like the spec says, rounds above shaCryptMaxRounds are rejected.
+func shaCryptRounds(s string) (rounds int, rest string, ok bool) {
+	if !strings.HasPrefix(s, roundsPrefix) {
+		return shaCryptDefaultRounds, s, true
+	}
+
+	i := strings.IndexByte(s, '$')
+	if i == -1 {
+		return
+	}
+
+	n, err := strconv.Atoi(s[len(roundsPrefix):i])
+	if err != nil || n > shaCryptMaxRounds {
+		return
+	}
+
+	if n < shaCryptMinRounds {
+		n = shaCryptMinRounds
+	}
+
+	return n, s[i+1:], true
+}
+
+// shaCrypt implements Ulrich Drepper's SHA-crypt, order is the byte order of the output encoding.
+func shaCrypt(newHash func() hash.Hash, magic string, order [][3]int, password, hash string) string {
+	var (
+		pw     = []byte(password)
+		rest   = hash[len(magic):]
+		rounds = shaCryptDefaultRounds
+		prefix = magic
+	)
+
+	if strings.HasPrefix(rest, roundsPrefix) {
+		var ok bool
+		if rounds, rest, ok = shaCryptRounds(rest); !ok {
+			return ""
+		}
+
+		prefix += roundsPrefix + strconv.Itoa(rounds) + "$"
+	}
+
+	salt := []byte(cryptSalt(rest, 16))
+
+	b := newHash()
+	b.Write(pw)
+	b.Write(salt)
+	b.Write(pw)
+	bSum := b.Sum(nil)
+	size := len(bSum)
+
+	a := newHash()
+	a.Write(pw)
+	a.Write(salt)
+	for i := len(pw); i > 0; i -= size {
+		if i > size {
+			a.Write(bSum)
+		} else {
+			a.Write(bSum[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(bSum)
+		} else {
+			a.Write(pw)
+		}
+	}
+	aSum := a.Sum(nil)
+
+	dp := newHash()
+	for range pw {
+		dp.Write(pw)
+	}
+	pSeq := cryptRepeat(dp.Sum(nil), len(pw))
+
+	ds := newHash()
+	for i := 0; i < 16+int(aSum[0]); i++ {
+		ds.Write(salt)
+	}
+	sSeq := cryptRepeat(ds.Sum(nil), len(salt))
+
+	c := aSum
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	out := make([]byte, 0, 86)
+	for _, o := range order {
+		out = cryptEncode(out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+
+	if size == sha256.Size {
+		out = cryptEncode(out, 0, c[31], c[30], 3)
+	} else {
+		out = cryptEncode(out, 0, 0, c[63], 2)
+	}
+
+	return prefix + string(salt) + "$" + string(out)
+}
+
+func cryptRepeat(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) >= len(sum) {
+			out = append(out, sum...)
+		} else {
+			out = append(out, sum[:n-len(out)]...)
+		}
+	}
+	return out
+}
+
+func cryptEncode(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
@@ -27,7 +27,11 @@ func HashPassword(password string) (string, error) {
 }
 
 // CheckPassword checks a hashed password against a plain-text password.
+// hash can be a bcrypt hash or any of the foreign formats supported by IsForeignHash.
 func CheckPassword(hash string, password string) bool {
+	if IsForeignHash(hash) {
+		return checkForeignPassword(hash, password)
+	}
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
@@ -40,6 +44,20 @@ func IsHashedPass(hash string) bool {
 	return err == nil && cost >= BCryptRounds
 }
 
+// IsSupportedHash checks if a password hash is a bcrypt hash of any cost or a foreign hash CheckPassword can verify.
+func IsSupportedHash(hash string) bool {
+	if IsForeignHash(hash) {
+		return true
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// NeedsRehash returns true if the hash should be replaced with a new bcrypt hash the next time the password is known.
+func NeedsRehash(hash string) bool {
+	return !IsHashedPass(hash)
+}
+
 // RandomToken returns a random `string` crypto/rand generated token with the given length.
 // If b64 is true, it will encode it with base64.RawURLEncoding otherwise uses hex.
 func RandomToken(ln int, b64 bool) string {
@@ -13,8 +13,8 @@ import (
 
 type Profile struct {
 	Name  string `json:"name,omitempty"`
-	Phone string `json:"phone,omitempty"`
-	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty" auth:"encrypt"`
+	Email string `json:"email,omitempty" auth:"encrypt,index"`
 
 	Agency     *Agency     `json:"agency,omitempty"`
 	Advertiser *Advertiser `json:"advertiser,omitempty"`
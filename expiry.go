@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"sort"
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+// PasswordPolicy is the password policy used by Auth, see Options.PasswordPolicy.
+type PasswordPolicy struct {
+	// MaxAge is how long a password is valid for, Login returns ErrPasswordExpired after that.
+	// Zero means passwords don't expire.
+	MaxAge time.Duration
+
+	// HistorySize is the number of previous passwords that can't be reused by Auth.SetPassword
+	// and Auth.ChangePassword.
+	HistorySize int
+}
+
+// ExpiryReport is an entry of Auth.ExpiringUsers, the zero times mean it doesn't expire.
+type ExpiryReport struct {
+	ID       string
+	Username string
+
+	AccountExpires  time.Time
+	PasswordExpires time.Time
+}
+
+// Expires returns the time the account expires, or the zero time if it doesn't.
+func (u *User) Expires() time.Time {
+	if u.ExpiresTS == 0 {
+		return time.Time{}
+	}
+	return time.Unix(u.ExpiresTS, 0)
+}
+
+// AccountExpired returns true if the account has an expiry time and it passed.
+func (u *User) AccountExpired() bool {
+	return u.ExpiresTS > 0 && u.ExpiresTS <= time.Now().Unix()
+}
+
+// PasswordChanged returns the time of the last password change, or the creation time if it was never changed.
+func (u *User) PasswordChanged() time.Time {
+	if u.PasswordChangedTS == 0 {
+		return u.Created()
+	}
+	return time.Unix(u.PasswordChangedTS, 0)
+}
+
+// PasswordExpires returns the time the password expires with the max age, or the zero time if maxAge is 0.
+func (u *User) PasswordExpires(maxAge time.Duration) time.Time {
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	return u.PasswordChanged().Add(maxAge)
+}
+
+// SetPassword hashes and sets the password of a user.
+// It returns ErrPasswordReused if it matches the current password or one in the password history.
+func (a *Auth) SetPassword(id, password string) error {
+	return a.setPassword(auditInfo{}, id, "", password)
+}
+
+// ChangePassword is SetPassword for users changing their own password, it checks the old password first.
+// Like Login it returns ErrBadStatus or ErrAccountExpired for users who can't log in, but it works with an
+// expired password, so it can be used after Login returns ErrPasswordExpired.
+func (a *Auth) ChangePassword(username, oldPassword, newPassword string) error {
+	return a.changePassword("", username, oldPassword, newPassword)
+}
+
+func (a *Auth) changePassword(tenant, username, oldPassword, newPassword string) error {
+	u, err := a.getUserByName(tenant, username)
+	if err != nil || !u.PasswordsMatch(oldPassword) {
+		return ErrInvalidLogin
+	}
+
+	if err = a.checkStatus(&u); err != nil {
+		return err
+	}
+
+	return a.setPassword(auditInfo{actor: u.ID}, u.ID, u.Password, newPassword)
+}
+
+// setPassword sets the password of a user, if oldHash isn't empty the user's password must still be oldHash.
+func (a *Auth) setPassword(ai auditInfo, id, oldHash, password string) error {
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+
+	if oldHash != "" && u.Password != oldHash {
+		return ErrInvalidLogin
+	}
+
+	// hash and check the history outside the db lock
+	if a.passwordReused(&u, password) {
+		return ErrPasswordReused
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return a.editUser(ai, id, "", func(eu *User) error {
+		if eu.Password != u.Password || !sameHistory(eu.PasswordHistory, u.PasswordHistory) {
+			// changed since it was checked
+			return ErrInvalidLogin
+		}
+
+		eu.Password = hash
+		return nil
+	})
+}
+
+func sameHistory(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *Auth) passwordReused(u *User, password string) bool {
+	if u.PasswordsMatch(password) {
+		return true
+	}
+
+	for i, h := range u.PasswordHistory {
+		if i == a.passwordPolicy.HistorySize {
+			break
+		}
+
+		if CheckPassword(h, password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyPasswordChange is called by prepareEdit after the edit func, it keeps the password history and
+// the password change time up to date.
+func (a *Auth) applyPasswordChange(old, u *User) {
+	if old.Password == u.Password {
+		return
+	}
+
+	u.PasswordChangedTS = time.Now().Unix()
+
+	n := a.passwordPolicy.HistorySize
+	if n <= 0 {
+		u.PasswordHistory = nil
+		return
+	}
+
+	// newest first
+	hist := make([]string, 0, n)
+	hist = append(hist, old.Password)
+	for _, h := range old.PasswordHistory {
+		if len(hist) == n {
+			break
+		}
+		hist = append(hist, h)
+	}
+
+	u.PasswordHistory = hist
+}
+
+// ExpiringUsers returns the users whose account or password expires within d, including the already
+// expired ones, sorted by the earliest expiry.
+func (a *Auth) ExpiringUsers(d time.Duration) (out []ExpiryReport, err error) {
+	var (
+		maxAge = a.passwordPolicy.MaxAge
+		before = time.Now().Add(d)
+	)
+
+	if err = a.read(func(tx turtleDB.Txn) error {
+		usersB, err := tx.Get("users")
+		if err != nil {
+			return err
+		}
+
+		return usersB.ForEach(func(_ string, val turtleDB.Value) error {
+			u, ok := val.(User)
+			if !ok {
+				return unexpectedTypeError(val)
+			}
+
+			if u.Status == StatusDeleted {
+				return nil
+			}
+
+			r := ExpiryReport{ID: u.ID, Username: u.Username}
+			if t := u.Expires(); !t.IsZero() && t.Before(before) {
+				r.AccountExpires = t
+			}
+
+			if t := u.PasswordExpires(maxAge); !t.IsZero() && t.Before(before) {
+				r.PasswordExpires = t
+			}
+
+			if !r.AccountExpires.IsZero() || !r.PasswordExpires.IsZero() {
+				out = append(out, r)
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].earliest().Before(out[j].earliest()) })
+	return
+}
+
+func (r *ExpiryReport) earliest() time.Time {
+	switch {
+	case r.AccountExpires.IsZero():
+		return r.PasswordExpires
+	case r.PasswordExpires.IsZero(), r.AccountExpires.Before(r.PasswordExpires):
+		return r.AccountExpires
+	}
+	return r.PasswordExpires
+}
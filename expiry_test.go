@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewWithOptions(tmpPath, Options{
+		PasswordPolicy: PasswordPolicy{MaxAge: 90 * 24 * time.Hour, HistorySize: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	id, err := a.CreateUser("janine", "pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cid, err := a.CreateUser("contractor", "pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.EditUserByID(cid, func(u *User) error {
+		u.ExpiresTS = time.Now().Add(-time.Minute).Unix()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Login("contractor", "pass-1"); err != ErrAccountExpired {
+		t.Fatalf("expected ErrAccountExpired, got %v", err)
+	}
+
+	if err = a.ChangePassword("contractor", "pass-1", "pass-2"); err != ErrAccountExpired {
+		t.Fatalf("expected ErrAccountExpired, got %v", err)
+	}
+
+	bid, err := a.CreateUser("slimer", "pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.SetStatus(bid, StatusBanned, StatusOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.ChangePassword("slimer", "pass-1", "pass-2"); err != ErrBadStatus {
+		t.Fatalf("expected ErrBadStatus, got %v", err)
+	}
+
+	if _, err = a.Login("janine", "pass-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// age the password
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.CreatedTS = time.Now().Add(-100 * 24 * time.Hour).Unix()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Login("janine", "pass-1"); err != ErrPasswordExpired {
+		t.Fatalf("expected ErrPasswordExpired, got %v", err)
+	}
+
+	rep, err := a.ExpiringUsers(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rep) != 2 || rep[0].ID != id || rep[0].PasswordExpires.IsZero() || rep[1].ID != cid || rep[1].AccountExpires.IsZero() {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+
+	if err = a.ChangePassword("janine", "wrong", "pass-2"); err != ErrInvalidLogin {
+		t.Fatalf("expected ErrInvalidLogin, got %v", err)
+	}
+
+	if err = a.ChangePassword("janine", "pass-1", "pass-1"); err != ErrPasswordReused {
+		t.Fatalf("expected ErrPasswordReused, got %v", err)
+	}
+
+	for _, pass := range []string{"pass-2", "pass-3"} {
+		if err = a.SetPassword(id, pass); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = a.Login("janine", "pass-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pass := range []string{"pass-1", "pass-2", "pass-3"} {
+		if err = a.SetPassword(id, pass); err != ErrPasswordReused {
+			t.Fatalf("%s: expected ErrPasswordReused, got %v", pass, err)
+		}
+	}
+
+	if err = a.SetPassword(id, "pass-4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// pass-1 dropped out of the history
+	if err = a.SetPassword(id, "pass-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(u.PasswordHistory) != 2 || u.PasswordChangedTS == 0 {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+}
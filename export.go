@@ -0,0 +1,447 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/PathDNA/auth/permissions"
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	// ExportVersion is the version of the format written by Export.
+	ExportVersion = 1
+
+	exportFormat = "auth"
+
+	// permissions records aren't stored in the auth db, they use these pseudo buckets.
+	permResourceBucket = "permissions.resource"
+	permGroupsBucket   = "permissions.groups"
+)
+
+// ConflictPolicy controls what Import does when a record already exists.
+type ConflictPolicy int8
+
+// ConflictPolicy values.
+const (
+	// ConflictFail aborts the import.
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip keeps the existing record.
+	ConflictSkip
+	// ConflictOverwrite replaces the existing record,
+	// a user holding the same username under a different ID is deleted.
+	ConflictOverwrite
+)
+
+// ImportOptions are the options used by Auth.Import.
+type ImportOptions struct {
+	Conflict ConflictPolicy
+
+	// Permissions is optional, if it is nil permissions records are skipped.
+	Permissions *permissions.Permissions
+}
+
+// ImportStats is returned by Auth.Import.
+type ImportStats struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Created int64  `json:"created"`
+}
+
+type exportRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Export writes all users (including their password hashes), login indexes, ID counters and tokens to w.
+// The output is JSON Lines, a header line followed by one line per record.
+func (a *Auth) Export(w io.Writer) error {
+	return a.ExportWithPermissions(w, nil)
+}
+
+// ExportWithPermissions is like Export but also exports the resources and groups of p if it isn't nil.
+func (a *Auth) ExportWithPermissions(w io.Writer, p *permissions.Permissions) (err error) {
+	return a.export(w, p, nil)
+}
+
+// export writes the records for which keep returns true, or all of them if keep is nil.
+func (a *Auth) export(w io.Writer, p *permissions.Permissions, keep func(bucket, key string, val turtleDB.Value) bool) (err error) {
+	var (
+		bw  = bufio.NewWriter(w)
+		enc = json.NewEncoder(bw)
+	)
+
+	if err = enc.Encode(exportHeader{exportFormat, ExportVersion, time.Now().Unix()}); err != nil {
+		return
+	}
+
+	put := func(bucket, key string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(exportRecord{bucket, key, b})
+	}
+
+	if err = a.read(func(tx turtleDB.Txn) error {
+		for _, name := range buckets {
+			switch name {
+			case blindBkt, auditBkt, outboxBkt, outboxDeadBkt, invitesBkt:
+				// the blind indexes are rebuilt on import, the audit log, the outbox and the invite codes belong to this store.
+				continue
+			}
+
+			bkt, err := tx.Get(name)
+			if err != nil {
+				return err
+			}
+
+			if err = bkt.ForEach(func(key string, val turtleDB.Value) error {
+				if keep != nil && !keep(name, key, val) {
+					return nil
+				}
+				return put(name, key, val)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	if p != nil {
+		if err = p.ForEachResource(func(id string, actions map[string]permissions.Action) error {
+			return put(permResourceBucket, id, actions)
+		}); err != nil {
+			return
+		}
+
+		if err = p.ForEachGroups(func(uuid string, groups []string) error {
+			return put(permGroupsBucket, uuid, groups)
+		}); err != nil {
+			return
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Import reads the output of Export from r.
+// All the auth records are imported in a single transaction, IDs are preserved and the ID counters
+// are only ever raised. Permissions records are applied afterwards if opts.Permissions is set,
+// with ConflictFail their conflicts are checked before anything is written.
+// An error while writing the permissions leaves the auth records imported.
+func (a *Auth) Import(r io.Reader, opts ImportOptions) (st ImportStats, err error) {
+	var (
+		dec  = json.NewDecoder(r)
+		hdr  exportHeader
+		recs []exportRecord
+	)
+
+	if err = dec.Decode(&hdr); err != nil {
+		return
+	}
+
+	if hdr.Format != exportFormat || hdr.Version != ExportVersion {
+		err = fmt.Errorf("%w: %s v%d", ErrImportVersion, hdr.Format, hdr.Version)
+		return
+	}
+
+	for {
+		var rec exportRecord
+		if err = dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+
+		recs = append(recs, rec)
+	}
+
+	if err = checkPermissions(opts, recs); err != nil {
+		return
+	}
+
+	if err = a.update(func(tx turtleDB.Txn) error {
+		return a.importRecords(tx, recs, opts.Conflict, &st)
+	}); err != nil {
+		return
+	}
+
+	for _, rec := range recs {
+		var ok bool
+		if ok, err = importPermission(opts, rec); err != nil {
+			return
+		}
+
+		if ok {
+			st.Imported++
+		} else if rec.Bucket == permResourceBucket || rec.Bucket == permGroupsBucket {
+			st.Skipped++
+		}
+	}
+
+	return
+}
+
+func (a *Auth) importRecords(tx turtleDB.Txn, recs []exportRecord, policy ConflictPolicy, st *ImportStats) error {
+	var (
+		usersB, _  = tx.Get("users")
+		loginsB, _ = tx.Get("logins")
+		tokensB, _ = tx.Get("tokens")
+
+		// login -> id of every user in the import, used to validate the login records
+		usernames = map[string]string{}
+	)
+
+	for _, rec := range recs {
+		switch rec.Bucket {
+		case "users":
+			u, err := a.decodeUser(rec.Value, false)
+			if err != nil {
+				return err
+			}
+
+			if err = u.Validate(); err != nil {
+				return fmt.Errorf("%w: user %q: %v", ErrInvalidImport, rec.Key, err)
+			}
+
+			if u.ID != rec.Key {
+				return fmt.Errorf("%w: user id %q != %q", ErrInvalidImport, u.ID, rec.Key)
+			}
+
+			tenant, n := splitUserID(u.ID)
+			if tenant != u.TenantID {
+				return fmt.Errorf("%w: user id %q doesn't match tenant %q", ErrInvalidImport, u.ID, u.TenantID)
+			}
+			usernames[loginKey(tenant, u.Username)] = u.ID
+
+			ok, err := a.importUser(tx, u, policy)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				st.Skipped++
+				continue
+			}
+
+			if err = a.setID(tx, tenantCounter(tenant), n); err != nil {
+				return err
+			}
+
+			if err = usersB.Put(u.ID, u); err != nil {
+				return err
+			}
+
+			if err = loginsB.Put(loginKey(tenant, u.Username), u.ID); err != nil {
+				return err
+			}
+
+			if err = a.reindexUser(tx, nil, u.ID); err != nil {
+				return err
+			}
+
+			st.Imported++
+
+		case "index":
+			var id string
+			if err := json.Unmarshal(rec.Value, &id); err != nil {
+				return err
+			}
+
+			if err := a.setID(tx, rec.Key, id); err != nil {
+				return err
+			}
+
+			st.Imported++
+
+		case "tokens":
+			var v interface{}
+			if err := json.Unmarshal(rec.Value, &v); err != nil {
+				return err
+			}
+
+			if _, err := tokensB.Get(rec.Key); err == nil {
+				switch policy {
+				case ConflictSkip:
+					st.Skipped++
+					continue
+				case ConflictFail:
+					return fmt.Errorf("%w: token %q", ErrRecordExists, rec.Key)
+				}
+			}
+
+			if err := tokensB.Put(rec.Key, v); err != nil {
+				return err
+			}
+
+			st.Imported++
+
+		case "logins", permResourceBucket, permGroupsBucket:
+			// handled below and after the transaction
+
+		default:
+			return fmt.Errorf("%w: unknown bucket %q", ErrInvalidImport, rec.Bucket)
+		}
+	}
+
+	// login indexes are written along with their users, the exported ones only have to agree with them.
+	for _, rec := range recs {
+		if rec.Bucket != "logins" {
+			continue
+		}
+
+		var id string
+		if err := json.Unmarshal(rec.Value, &id); err != nil {
+			return err
+		}
+
+		if usernames[rec.Key] != id {
+			return fmt.Errorf("%w: login %q doesn't match any user", ErrInvalidImport, rec.Key)
+		}
+	}
+
+	return nil
+}
+
+// importUser resolves the conflicts of u with the existing users, it returns false if u should be skipped.
+func (a *Auth) importUser(tx turtleDB.Txn, u User, policy ConflictPolicy) (ok bool, err error) {
+	var (
+		usersB, _  = tx.Get("users")
+		loginsB, _ = tx.Get("logins")
+	)
+
+	old, oerr := GetUserByIDTx(tx, u.ID)
+	oid, _ := GetUserIDTx(tx, loginKey(u.TenantID, u.Username))
+
+	if oerr != nil && oid == "" {
+		return true, nil
+	}
+
+	switch policy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictFail:
+		return false, fmt.Errorf("%w: %s (%s)", ErrUserExists, u.Username, u.ID)
+	}
+
+	if oerr == nil {
+		if err = a.unindexUser(tx, &old); err != nil {
+			return
+		}
+
+		if err = loginsB.Delete(loginKey(old.TenantID, old.Username)); err != nil {
+			return
+		}
+	}
+
+	if oid != "" && oid != u.ID {
+		var other User
+		if other, err = GetUserByIDTx(tx, oid); err != nil {
+			return
+		}
+
+		if err = a.unindexUser(tx, &other); err != nil {
+			return
+		}
+
+		if err = usersB.Delete(oid); err != nil {
+			return
+		}
+
+		if err = loginsB.Delete(loginKey(u.TenantID, u.Username)); err != nil {
+			return
+		}
+	}
+
+	return true, nil
+}
+
+// checkPermissions will validate the permissions records, and look for their conflicts with ConflictFail,
+// before the auth records are written
+func checkPermissions(opts ImportOptions, recs []exportRecord) (err error) {
+	p := opts.Permissions
+	if p == nil {
+		return
+	}
+
+	for _, rec := range recs {
+		var exists bool
+		switch rec.Bucket {
+		case permResourceBucket:
+			var actions map[string]permissions.Action
+			if err = json.Unmarshal(rec.Value, &actions); err != nil {
+				return
+			}
+
+			exists = p.HasResource(rec.Key)
+
+		case permGroupsBucket:
+			var groups []string
+			if err = json.Unmarshal(rec.Value, &groups); err != nil {
+				return
+			}
+
+			exists = p.HasGroups(rec.Key)
+
+		default:
+			continue
+		}
+
+		if exists && opts.Conflict == ConflictFail {
+			return fmt.Errorf("%w: permissions %q", ErrRecordExists, rec.Key)
+		}
+	}
+
+	return
+}
+
+func importPermission(opts ImportOptions, rec exportRecord) (ok bool, err error) {
+	p := opts.Permissions
+	if p == nil {
+		return
+	}
+
+	switch rec.Bucket {
+	case permResourceBucket:
+		var actions map[string]permissions.Action
+		if err = json.Unmarshal(rec.Value, &actions); err != nil {
+			return
+		}
+
+		err = p.PutResource(rec.Key, actions, opts.Conflict == ConflictOverwrite)
+
+	case permGroupsBucket:
+		var groups []string
+		if err = json.Unmarshal(rec.Value, &groups); err != nil {
+			return
+		}
+
+		err = p.PutGroups(rec.Key, groups, opts.Conflict == ConflictOverwrite)
+
+	default:
+		return
+	}
+
+	switch {
+	case err == nil:
+		return true, nil
+	case err == permissions.ErrExists && opts.Conflict == ConflictSkip:
+		return false, nil
+	case err == permissions.ErrExists:
+		err = fmt.Errorf("%w: permissions %q", ErrRecordExists, rec.Key)
+	}
+
+	return
+}
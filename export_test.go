@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/PathDNA/auth/permissions"
+)
+
+func TestExportImport(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	src, err := NewTyped[Profile](filepath.Join(tmpPath, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	srcPerms, err := permissions.New(filepath.Join(tmpPath, "srcPerms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcPerms.Close()
+
+	id1, err := src.CreateUser("egon", "print is dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := src.CreateUserWithID("7", "ray", "ray is a god")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.EditUserByID(id1, func(u *TypedUser[Profile]) error {
+		u.Profile = &Profile{Name: "Egon Spengler"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = srcPerms.SetPermissions("traps", "staff", permissions.ActionRead|permissions.ActionWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = srcPerms.AddGroup(id2, "staff"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = src.ExportWithPermissions(&buf, srcPerms); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewTyped[Profile](filepath.Join(tmpPath, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	dstPerms, err := permissions.New(filepath.Join(tmpPath, "dstPerms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstPerms.Close()
+
+	opts := ImportOptions{Permissions: dstPerms}
+	st, err := dst.Import(bytes.NewReader(buf.Bytes()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 users, 1 index, 1 resource, 1 groups
+	if st.Imported != 5 || st.Skipped != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	u, err := dst.GetUserByName("egon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID != id1 || !u.PasswordsMatch("print is dead") || u.Profile == nil || u.Profile.Name != "Egon Spengler" {
+		t.Fatalf("unexpected user: %+v %+v", u.User, u.Profile)
+	}
+
+	if !dstPerms.Can(id2, "traps", permissions.ActionWrite) {
+		t.Fatal("expected the imported permissions to allow writing")
+	}
+
+	if id, err := dst.CreateUser("winston", "ive seen some stuff"); err != nil {
+		t.Fatal(err)
+	} else if id != "8" {
+		t.Fatalf("expected the id counter to be preserved, got %s", id)
+	}
+
+	if _, err = dst.Import(bytes.NewReader(buf.Bytes()), opts); err == nil {
+		t.Fatal("expected ConflictFail to fail")
+	}
+
+	// a conflict of the permissions alone fails before any user is written
+	empty, err := New(filepath.Join(tmpPath, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+
+	if _, err = empty.Import(bytes.NewReader(buf.Bytes()), opts); err == nil {
+		t.Fatal("expected ConflictFail to fail")
+	}
+
+	if _, err = empty.GetUserByName("egon"); err == nil {
+		t.Fatal("expected no imported users")
+	}
+
+	// the users are validated before they are written
+	invalid := regexp.MustCompile(`"password":"[^"]*"`).ReplaceAll(buf.Bytes(), []byte(`"password":"plain"`))
+	if _, err = empty.Import(bytes.NewReader(invalid), ImportOptions{}); !errors.Is(err, ErrInvalidImport) {
+		t.Fatalf("expected ErrInvalidImport, got %v", err)
+	}
+
+	if _, err = empty.GetUserByName("egon"); err == nil {
+		t.Fatal("expected no imported users")
+	}
+
+	opts.Conflict = ConflictSkip
+	if st, err = dst.Import(bytes.NewReader(buf.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	} else if st.Skipped != 4 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if err = dst.EditUserByID(id1, func(u *TypedUser[Profile]) error {
+		u.Username = "spengler"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Conflict = ConflictOverwrite
+	if _, err = dst.Import(bytes.NewReader(buf.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = dst.GetUserByName("spengler"); err == nil {
+		t.Fatal("expected the old username to be removed on overwrite")
+	}
+
+	if _, err = dst.GetUserByName("egon"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,619 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	// fieldTag is the struct tag used to mark profile fields for encryption,
+	// `auth:"encrypt"` encrypts the field and `auth:"encrypt,index"` also maintains a blind index for it.
+	fieldTag = "auth"
+
+	fieldKeysSuffix = ".fieldkeys"
+	dataKeysBkt     = "keys"
+	blindBkt        = "blind"
+)
+
+var blindIndexMsg = []byte("PathDNA/auth blind index")
+
+// fieldSpec is a profile field marked for encryption.
+type fieldSpec struct {
+	name  string // json name
+	index []int  // reflect field index
+	blind bool
+}
+
+var fieldSpecsCache sync.Map // reflect.Type -> []fieldSpec
+
+// profileFieldSpecs returns the encrypted fields of a profile, only top-level string fields of struct profiles are supported.
+func profileFieldSpecs(profile interface{}) (specs []fieldSpec, err error) {
+	if profile == nil {
+		return
+	}
+
+	t := reflect.TypeOf(profile)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return
+	}
+
+	if v, ok := fieldSpecsCache.Load(t); ok {
+		return v.([]fieldSpec), nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		opts := strings.Split(f.Tag.Get(fieldTag), ",")
+		if opts[0] != "encrypt" {
+			continue
+		}
+
+		if f.Type.Kind() != reflect.String {
+			return nil, ErrEncryptedField
+		}
+
+		spec := fieldSpec{name: f.Name, index: f.Index}
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			spec.name = name
+		}
+
+		for _, o := range opts[1:] {
+			spec.blind = spec.blind || o == "index"
+		}
+
+		specs = append(specs, spec)
+	}
+
+	fieldSpecsCache.Store(t, specs)
+	return
+}
+
+// profileField returns the value of an encrypted field of profile.
+func profileField(profile interface{}, spec fieldSpec) string {
+	v := reflect.Indirect(reflect.ValueOf(profile))
+	if !v.IsValid() {
+		return ""
+	}
+	return v.FieldByIndex(spec.index).String()
+}
+
+// fieldCrypter encrypts profile fields with per-user data keys, the data keys are stored in their own db
+// wrapped with the field key.
+type fieldCrypter struct {
+	kek      cipher.AEAD
+	indexKey []byte
+
+	keys  *turtleDB.Turtle
+	cache sync.Map // user id -> cipher.AEAD
+}
+
+func newFieldCrypter(fieldKey []byte, path string) (fc *fieldCrypter, err error) {
+	var c fieldCrypter
+	if c.kek, err = newGCM(fieldKey); err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, fieldKey)
+	mac.Write(blindIndexMsg)
+	c.indexKey = mac.Sum(nil)
+
+	if c.keys, err = turtleDB.New("fieldkeys", path, turtleDB.NewFuncsMap(turtleDB.MarshalJSON, turtleDB.UnmarshalJSON)); err != nil {
+		return
+	}
+
+	if err = c.keys.Update(func(tx turtleDB.Txn) error {
+		_, err := tx.Create(dataKeysBkt)
+		return err
+	}); err != nil {
+		c.keys.Close()
+		return
+	}
+
+	return &c, nil
+}
+
+// dataKey returns the data key of a user, if the user has none and create is false it returns nil.
+func (fc *fieldCrypter) dataKey(id string, create bool) (aead cipher.AEAD, err error) {
+	if v, ok := fc.cache.Load(id); ok {
+		return v.(cipher.AEAD), nil
+	}
+
+	var wrapped string
+	if err = fc.keys.Read(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(dataKeysBkt)
+		if err != nil {
+			return err
+		}
+
+		v, err := bkt.Get(id)
+		if err == nil {
+			wrapped, _ = v.(string)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	if wrapped == "" && create {
+		if err = fc.keys.Update(func(tx turtleDB.Txn) error {
+			bkt, err := tx.Get(dataKeysBkt)
+			if err != nil {
+				return err
+			}
+
+			// another goroutine might have beaten us to it
+			if v, err := bkt.Get(id); err == nil {
+				wrapped, _ = v.(string)
+				return nil
+			}
+
+			dk := make([]byte, 32)
+			if _, err = rand.Read(dk); err != nil {
+				return err
+			}
+
+			if wrapped, err = sealField(fc.kek, dk, []byte(id)); err != nil {
+				return err
+			}
+
+			return bkt.Put(id, wrapped)
+		}); err != nil {
+			return
+		}
+	}
+
+	if wrapped == "" {
+		return
+	}
+
+	var dk []byte
+	if dk, err = openField(fc.kek, wrapped, []byte(id)); err != nil {
+		return
+	}
+
+	if aead, err = newGCM(dk); err != nil {
+		return
+	}
+
+	fc.cache.Store(id, aead)
+	return
+}
+
+// shred deletes the data key of a user.
+func (fc *fieldCrypter) shred(id string) error {
+	defer fc.cache.Delete(id)
+	return fc.keys.Update(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(dataKeysBkt)
+		if err != nil {
+			return err
+		}
+		return bkt.Delete(id)
+	})
+}
+
+// encrypt replaces the encrypted fields in the json of u with their ciphertext.
+func (fc *fieldCrypter) encrypt(u *User, b []byte) ([]byte, error) {
+	specs, err := profileFieldSpecs(u.Profile)
+	if err != nil || len(specs) == 0 {
+		return b, err
+	}
+
+	aead, err := fc.dataKey(u.ID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapProfileFields(b, specs, func(name, val string) (string, error) {
+		return sealField(aead, []byte(val), fieldAD(u.ID, name))
+	})
+}
+
+// decrypt replaces the encrypted fields in the json of a user with their plain-text,
+// fields of a user without a data key are removed.
+func (fc *fieldCrypter) decrypt(b []byte, profile interface{}) ([]byte, error) {
+	specs, err := profileFieldSpecs(profile)
+	if err != nil || len(specs) == 0 {
+		return b, err
+	}
+
+	var hdr struct {
+		ID string `json:"id"`
+	}
+
+	if err = json.Unmarshal(b, &hdr); err != nil {
+		return nil, err
+	}
+
+	aead, err := fc.dataKey(hdr.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapProfileFields(b, specs, func(name, val string) (string, error) {
+		if aead == nil {
+			// shredded
+			return "", nil
+		}
+
+		pt, err := openField(aead, val, fieldAD(hdr.ID, name))
+		return string(pt), err
+	})
+}
+
+// decryptLoaded returns the json of a user with only the profile of id, decrypting the fields of profile which was
+// decoded without the profile func so they still hold their ciphertext. typed is the profile the fields are read from,
+// values which don't decrypt are kept as they are since they were written in plain-text.
+func (fc *fieldCrypter) decryptLoaded(id string, profile, typed interface{}) ([]byte, error) {
+	specs, err := profileFieldSpecs(typed)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"profile": profile})
+	if err != nil || len(specs) == 0 {
+		return b, err
+	}
+
+	aead, err := fc.dataKey(id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapProfileFields(b, specs, func(name, val string) (string, error) {
+		if aead == nil {
+			// shredded
+			return "", nil
+		}
+
+		if pt, err := openField(aead, val, fieldAD(id, name)); err == nil {
+			return string(pt), nil
+		}
+		return val, nil
+	})
+}
+
+// blindIndex returns the blind index key of a field value.
+func (fc *fieldCrypter) blindIndex(name, val string) string {
+	mac := hmac.New(sha256.New, fc.indexKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(val))
+	return name + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// reindex updates the blind indexes of a user that changed from old to u, old may be nil for new users.
+func (fc *fieldCrypter) reindex(tx turtleDB.Txn, old, u *User) error {
+	specs, err := profileFieldSpecs(u.Profile)
+	if err != nil {
+		return err
+	}
+
+	vals := map[string]string{}
+	for _, spec := range specs {
+		if spec.blind {
+			vals[spec.name] = profileField(u.Profile, spec)
+		}
+	}
+
+	oldVals := map[string]string{}
+	if old != nil {
+		ospecs, err := profileFieldSpecs(old.Profile)
+		if err != nil {
+			return err
+		}
+
+		for _, spec := range ospecs {
+			if !spec.blind {
+				continue
+			}
+
+			ov := profileField(old.Profile, spec)
+			if oldVals[spec.name] = ov; ov == "" || ov == vals[spec.name] {
+				continue
+			}
+
+			if err = fc.updateIndex(tx, fc.blindIndex(spec.name, ov), old.ID, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, v := range vals {
+		if v == "" || v == oldVals[name] {
+			continue
+		}
+
+		if err = fc.updateIndex(tx, fc.blindIndex(name, v), u.ID, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fc *fieldCrypter) updateIndex(tx turtleDB.Txn, key, id string, add bool) error {
+	bkt, err := tx.Get(blindBkt)
+	if err != nil {
+		return err
+	}
+
+	ids, err := getBlindIDs(bkt, key)
+	if err != nil {
+		return err
+	}
+
+	out := make(blindIDs, 0, len(ids)+1)
+	for _, oid := range ids {
+		if oid != id {
+			out = append(out, oid)
+		}
+	}
+
+	if add {
+		out = append(out, id)
+	}
+
+	if len(out) == 0 {
+		return bkt.Delete(key)
+	}
+
+	return bkt.Put(key, out)
+}
+
+func (fc *fieldCrypter) close() error {
+	return fc.keys.Close()
+}
+
+// LookupByField returns the IDs of the users whose profile field (by its json name) equals val.
+// The field must be tagged with `auth:"encrypt,index"`.
+func (a *Auth) LookupByField(field, val string) (ids []string, err error) {
+	if a.fields == nil {
+		return nil, ErrNoFieldKey
+	}
+
+	err = a.read(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(blindBkt)
+		if err != nil {
+			return err
+		}
+
+		ids, err = getBlindIDs(bkt, a.fields.blindIndex(field, val))
+		return err
+	})
+	return
+}
+
+// ShredUser clears the encrypted profile fields of a user and deletes their data key,
+// making the fields unrecoverable from older copies of the store as well.
+func (a *Auth) ShredUser(id string) error {
+	if a.fields == nil {
+		return ErrNoFieldKey
+	}
+
+	if err := a.EditUserByID(id, func(u *User) error {
+		specs, err := profileFieldSpecs(u.Profile)
+		if err != nil || len(specs) == 0 {
+			return err
+		}
+
+		// work on a copy, the profile may be shared with the stored user.
+		pv := reflect.Indirect(reflect.ValueOf(u.Profile))
+		cp := reflect.New(pv.Type())
+		cp.Elem().Set(pv)
+		for _, spec := range specs {
+			cp.Elem().FieldByIndex(spec.index).SetString("")
+		}
+
+		u.Profile = cp.Interface()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return a.fields.shred(id)
+}
+
+// ReindexFields rebuilds the blind indexes of all the users.
+func (a *Auth) ReindexFields() error {
+	if a.fields == nil {
+		return ErrNoFieldKey
+	}
+
+	return a.update(func(tx turtleDB.Txn) error {
+		blindB, err := tx.Get(blindBkt)
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		if err = blindB.ForEach(func(key string, _ turtleDB.Value) error {
+			keys = append(keys, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err = blindB.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		usersB, err := tx.Get("users")
+		if err != nil {
+			return err
+		}
+
+		return usersB.ForEach(func(_ string, val turtleDB.Value) error {
+			u, ok := val.(User)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+			return a.fields.reindex(tx, nil, &u)
+		})
+	})
+}
+
+// reindexUser is called after a user is written, old is nil for new users.
+func (a *Auth) reindexUser(tx turtleDB.Txn, old *User, id string) error {
+	if a.fields == nil {
+		return nil
+	}
+
+	u, err := GetUserByIDTx(tx, id)
+	if err != nil {
+		return err
+	}
+
+	return a.fields.reindex(tx, old, &u)
+}
+
+// unindexUser removes the blind indexes of a deleted user.
+func (a *Auth) unindexUser(tx turtleDB.Txn, u *User) error {
+	if a.fields == nil {
+		return nil
+	}
+
+	return a.fields.reindex(tx, u, &User{ID: u.ID})
+}
+
+type blindIDs []string
+
+func getBlindIDs(bkt turtleDB.Bucket, key string) (ids blindIDs, err error) {
+	v, err := bkt.Get(key)
+	switch err {
+	case nil:
+	case turtleDB.ErrKeyDoesNotExist:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	if ids, _ = v.(blindIDs); ids == nil {
+		err = turtleDB.ErrInvalidType
+	}
+	return
+}
+
+func marshalBlindIDs(v turtleDB.Value) ([]byte, error) {
+	ids, ok := v.(blindIDs)
+	if !ok {
+		return nil, unexpectedTypeError(v)
+	}
+	return json.Marshal([]string(ids))
+}
+
+func unmarshalBlindIDs(b []byte) (turtleDB.Value, error) {
+	var ids blindIDs
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// mapProfileFields applies fn to the non-empty encrypted fields of the profile in the json of a user.
+func mapProfileFields(b []byte, specs []fieldSpec, fn func(name, val string) (string, error)) ([]byte, error) {
+	var rec map[string]json.RawMessage
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+
+	var profile map[string]json.RawMessage
+	if raw, ok := rec["profile"]; !ok {
+		return b, nil
+	} else if err := json.Unmarshal(raw, &profile); err != nil || profile == nil {
+		// not an object, nothing to do
+		return b, nil
+	}
+
+	for _, spec := range specs {
+		raw, ok := profile[spec.name]
+		if !ok {
+			continue
+		}
+
+		var val string
+		if err := json.Unmarshal(raw, &val); err != nil {
+			return nil, err
+		}
+
+		if val == "" {
+			continue
+		}
+
+		nv, err := fn(spec.name, val)
+		if err != nil {
+			return nil, err
+		}
+
+		if nv == "" {
+			delete(profile, spec.name)
+			continue
+		}
+
+		if profile[spec.name], err = json.Marshal(nv); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if rec["profile"], err = json.Marshal(profile); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(rec)
+}
+
+func fieldAD(id, name string) []byte {
+	return []byte(id + "\x00" + name)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealField encrypts pt and returns the base64 of the nonce and ciphertext.
+func sealField(aead cipher.AEAD, pt, ad []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(pt)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, pt, ad)), nil
+}
+
+// openField decrypts the output of sealField.
+func openField(aead cipher.AEAD, s string, ad []byte) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	pt, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return pt, nil
+}
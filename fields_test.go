@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type piiProfile struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty" auth:"encrypt,index"`
+	Phone string `json:"phone,omitempty" auth:"encrypt"`
+}
+
+func TestFieldEncryption(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		opts = Options{FieldKey: []byte("0123456789abcdef0123456789abcdef")}
+	)
+
+	a, err := NewTypedWithOptions[piiProfile](path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("egon", "print is dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := a.CreateUser("egon2", "print is dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uid := range []string{id, id2} {
+		if err = a.EditUserByID(uid, func(u *TypedUser[piiProfile]) error {
+			u.Profile = &piiProfile{Name: "Egon", Email: "egon@gb.com", Phone: "555-2368"}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := a.Auth.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := a.marshalUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte("Egon")) || bytes.Contains(b, []byte("egon@gb.com")) || bytes.Contains(b, []byte("555-2368")) {
+		t.Fatalf("expected only the tagged fields to be encrypted: %s", b)
+	}
+
+	if ids, err := a.LookupByField("email", "egon@gb.com"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []string{id, id2}) {
+		t.Fatalf("unexpected lookup result: %v", ids)
+	}
+
+	if err = a.EditUserByID(id2, func(u *TypedUser[piiProfile]) error {
+		u.Profile = &piiProfile{Email: "egon@spengler.com"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if a, err = NewTypedWithOptions[piiProfile](path, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tu, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *tu.Profile != (piiProfile{Name: "Egon", Email: "egon@gb.com", Phone: "555-2368"}) {
+		t.Fatalf("unexpected decrypted profile: %+v", tu.Profile)
+	}
+
+	if ids, err := a.LookupByField("email", "egon@spengler.com"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []string{id2}) {
+		t.Fatalf("unexpected lookup result: %v", ids)
+	}
+
+	if err = a.ShredUser(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := a.LookupByField("email", "egon@gb.com"); err != nil || len(ids) != 0 {
+		t.Fatalf("expected the shredded user to be unindexed: %v %v", ids, err)
+	}
+
+	// an old copy of the record can't be decrypted anymore
+	if v, err := a.unmarshalUser(b); err != nil {
+		t.Fatal(err)
+	} else if p := v.(User).Profile.(*piiProfile); *p != (piiProfile{Name: "Egon"}) {
+		t.Fatalf("expected the encrypted fields to be gone: %+v", p)
+	}
+	a.Close()
+
+	if a, err = NewTypedWithOptions[piiProfile](path, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if tu, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	} else if *tu.Profile != (piiProfile{Name: "Egon"}) {
+		t.Fatalf("unexpected shredded profile: %+v", tu.Profile)
+	}
+}
+
+func TestTypedFieldEncryption(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		opts = Options{FieldKey: []byte("0123456789abcdef0123456789abcdef")}
+		want = piiProfile{Name: "Ray", Email: "ray@gb.com", Phone: "555-2368"}
+	)
+
+	ta, err := NewTypedWithOptions[piiProfile](path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := ta.CreateUser("ray", "everything was fine with our system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ta.EditUserByID(id, func(u *TypedUser[piiProfile]) error {
+		u.Profile = &piiProfile{Name: "Raymond", Email: want.Email, Phone: want.Phone}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ta.Close()
+
+	// the profiles are loaded without a profile func, their encrypted fields still hold the ciphertext
+	a, err := NewWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta = Typed[piiProfile](a)
+	if err = ta.EditUserByID(id, func(u *TypedUser[piiProfile]) error {
+		u.Profile.Name = want.Name
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := u.Profile.(*piiProfile); !ok || *p != want {
+		t.Fatalf("unexpected untyped profile: %#+v", u.Profile)
+	}
+	a.Close()
+
+	if ta, err = NewTypedWithOptions[piiProfile](path, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer ta.Close()
+
+	if tu, err := ta.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	} else if *tu.Profile != want {
+		t.Fatalf("unexpected decrypted profile: %+v", tu.Profile)
+	}
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+// HookType is the type of a user lifecycle event.
+type HookType uint8
+
+// HookType values.
+const (
+	// HookCreate is a new user, Old is nil.
+	HookCreate HookType = iota + 1
+	// HookEdit is any edit of a user.
+	HookEdit
+	// HookDelete is a deleted user, New is nil.
+	HookDelete
+	// HookStatus is an edit that changed the user's status or set it again, see Auth.SetStatus.
+	// It comes right after the HookEdit of the same edit.
+	HookStatus
+	// HookLogin is a successful login, Old is nil.
+	HookLogin
+)
+
+var hookTypeNames = [...]string{"", "create", "edit", "delete", "status", "login"}
+
+func (t HookType) String() string {
+	if int(t) < len(hookTypeNames) && t > 0 {
+		return hookTypeNames[t]
+	}
+	return "HookType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// HookEvent is passed to the hooks, Old and New are copies so hooks may keep them.
+type HookEvent struct {
+	Type HookType
+
+	// Actor is the ID of the user performing the action, see Auth.Actor.
+	Actor string
+	// Impersonator is the ID of the real user if Actor is being impersonated, see Auth.Impersonate.
+	Impersonator string
+
+	Old *User
+	New *User
+}
+
+// BeforeHook is called before a change is committed, returning an error cancels the change and is returned
+// to the caller.
+// Before hooks run outside of the database lock, so they may call Auth's methods. The change is only committed
+// if the user wasn't changed in the meantime, otherwise the edit function and the hooks run again with the
+// new user. The new users of HookCreate don't have their ID yet, unless it was given to CreateUserWithID.
+type BeforeHook func(ev *HookEvent) error
+
+// errUserChanged is returned when a user changed while the before hooks of a change ran.
+const errUserChanged = errors.Error("the user changed while the hooks ran")
+
+// AfterHook is called after a change is committed, outside of the database lock.
+// After hooks run in the caller's goroutine in the order they were registered.
+type AfterHook func(ev *HookEvent)
+
+type hooks struct {
+	mux    sync.RWMutex
+	before map[HookType][]BeforeHook
+	after  map[HookType][]AfterHook
+}
+
+// Before registers fn to be called before the events of type t, see BeforeHook.
+// Imports don't trigger any hooks.
+func (a *Auth) Before(t HookType, fn BeforeHook) {
+	h := &a.hooks
+	h.mux.Lock()
+	if h.before == nil {
+		h.before = make(map[HookType][]BeforeHook)
+	}
+	h.before[t] = append(h.before[t], fn)
+	h.mux.Unlock()
+}
+
+// After registers fn to be called after the events of type t were committed, see AfterHook.
+// Imports don't trigger any hooks.
+func (a *Auth) After(t HookType, fn AfterHook) {
+	h := &a.hooks
+	h.mux.Lock()
+	if h.after == nil {
+		h.after = make(map[HookType][]AfterHook)
+	}
+	h.after[t] = append(h.after[t], fn)
+	h.mux.Unlock()
+}
+
+// runBefore calls the before hooks of evs, it stops at the first error.
+func (h *hooks) runBefore(evs []HookEvent) error {
+	for i := range evs {
+		h.mux.RLock()
+		fns := h.before[evs[i].Type]
+		h.mux.RUnlock()
+
+		for _, fn := range fns {
+			if err := fn(&evs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// runAfter calls the after hooks of evs, the lock isn't held while they run so they may register hooks.
+func (h *hooks) runAfter(evs []HookEvent) {
+	for i := range evs {
+		h.mux.RLock()
+		fns := h.after[evs[i].Type]
+		h.mux.RUnlock()
+
+		for _, fn := range fns {
+			fn(&evs[i])
+		}
+	}
+}
+
+// hookEvents returns the events of a change from old to u, either can be nil.
+func hookEvents(typ HookType, ai auditInfo, old, u *User) []HookEvent {
+	evs := []HookEvent{{Type: typ, Actor: ai.actor, Impersonator: ai.impersonator, Old: copyUser(old), New: copyUser(u)}}
+	if typ == HookEdit && statusChanged(old, u) {
+		ev := evs[0]
+		ev.Type, ev.Old, ev.New = HookStatus, copyUser(old), copyUser(u)
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// copyUser returns a deep copy of u, the profile is copied through its json.
+func copyUser(u *User) *User {
+	if u == nil {
+		return nil
+	}
+
+	cp := *u
+	cp.PasswordHistory = append([]string(nil), u.PasswordHistory...)
+	cp.StatusHistory = append([]StatusChange(nil), u.StatusHistory...)
+	cp.Profile = copyProfile(u.Profile)
+	return &cp
+}
+
+// copyProfile returns a copy of profile of the same type, profiles are stored as json so it can't fail
+// for a stored user, the original is returned if it does.
+func copyProfile(profile interface{}) interface{} {
+	if profile == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return profile
+	}
+
+	t := reflect.TypeOf(profile)
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if json.Unmarshal(b, v.Interface()) != nil {
+			return profile
+		}
+		return v.Interface()
+	}
+
+	v := reflect.New(t)
+	if json.Unmarshal(b, v.Interface()) != nil {
+		return profile
+	}
+	return v.Elem().Interface()
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+func TestHooks(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := New(tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	const errReserved = errors.Error("reserved username")
+
+	a.Before(HookCreate, func(ev *HookEvent) error {
+		if strings.HasPrefix(ev.New.Username, "admin") {
+			return errReserved
+		}
+		return nil
+	})
+
+	a.Before(HookLogin, func(ev *HookEvent) error {
+		if ev.New.Status != StatusActive {
+			return ErrBadStatus
+		}
+		return nil
+	})
+
+	var got []HookType
+	for _, typ := range []HookType{HookCreate, HookEdit, HookDelete, HookStatus, HookLogin} {
+		a.After(typ, func(ev *HookEvent) {
+			got = append(got, ev.Type)
+
+			// after hooks run outside of the lock
+			if ev.New != nil {
+				if _, err := a.GetUserByID(ev.New.ID); err != nil {
+					t.Errorf("%d: %v", ev.Type, err)
+				}
+			}
+		})
+	}
+
+	if _, err = a.CreateUser("admin2", "password"); err != errReserved {
+		t.Fatalf("expected errReserved, got %v", err)
+	}
+
+	if _, err = a.GetUserByName("admin2"); err == nil {
+		t.Fatalf("vetoed user was created")
+	}
+
+	id, err := a.CreateUser("peter", "venkman")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Login("peter", "venkman"); err != ErrBadStatus {
+		t.Fatalf("expected ErrBadStatus, got %v", err)
+	}
+
+	var status *HookEvent
+	a.After(HookStatus, func(ev *HookEvent) { status = ev })
+
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.Status = StatusActive
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status == nil || status.Old.Status != StatusInactive || status.New.Status != StatusActive {
+		t.Fatalf("unexpected status event: %+v", status)
+	}
+
+	// hooks may register hooks, and changing their copies doesn't reach the stored user
+	a.After(HookStatus, func(ev *HookEvent) {
+		a.After(HookStatus, func(*HookEvent) {})
+		ev.New.StatusHistory[0].Reason = "nope"
+		ev.New.Profile.(map[string]interface{})["name"] = "nope"
+	})
+
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.Status = StatusInactive
+		u.Profile = map[string]interface{}{"name": "Peter"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.StatusHistory[0].Reason == "nope" || u.Profile.(map[string]interface{})["name"] != "Peter" {
+		t.Fatalf("a hook changed the stored user: %+v", u)
+	}
+
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.Status = StatusActive
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Login("peter", "venkman"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.DeleteUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []HookType{HookCreate, HookEdit, HookStatus, HookEdit, HookStatus, HookEdit, HookStatus, HookLogin, HookDelete}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+	}
+}
+
+func TestBeforeHookConflict(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := New(tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	id, err := a.CreateUser("egon", "spengler")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// before hooks may call Auth, the first one changes the user so the edit runs again
+	var calls int
+	a.Before(HookEdit, func(ev *HookEvent) error {
+		if calls++; calls > 1 {
+			return nil
+		}
+
+		return a.EditUserByID(id, func(u *User) error {
+			u.Profile = map[string]interface{}{"name": "Egon"}
+			return nil
+		})
+	})
+
+	var edits int
+	if err = a.EditUserByID(id, func(u *User) error {
+		edits++
+		u.Status = StatusActive
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if edits != 2 || calls != 3 {
+		t.Fatalf("expected 2 edits and 3 hook calls, got %d and %d", edits, calls)
+	}
+
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Status != StatusActive || u.Profile.(map[string]interface{})["name"] != "Egon" {
+		t.Fatalf("an edit was lost: %+v", u)
+	}
+
+	a.Before(HookDelete, func(ev *HookEvent) error {
+		_, err := a.GetUserByID(ev.Old.ID)
+		return err
+	})
+
+	if err = a.DeleteUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/PathDNA/auth/permissions"
+	"github.com/PathDNA/auth/sessions"
+)
+
+const (
+	// ImpersonateResource is the permissions resource checked by Auth.Impersonate,
+	// admins need permissions.ActionWrite on it.
+	ImpersonateResource = "auth.impersonate"
+
+	// DefaultImpersonationTTL is the ttl of impersonation sessions, it isn't extended by activity.
+	DefaultImpersonationTTL = 15 * time.Minute
+)
+
+// Impersonate starts a session acting as the user id from the admin session token/key,
+// it returns the token/key pair of the impersonation session which expires after DefaultImpersonationTTL.
+// The admin must have permissions.ActionWrite on ImpersonateResource, and users that can impersonate
+// can't be impersonated.
+// Use Auth.SessionActor to perform actions with the session, it can't change the user's credentials.
+// Callers using sessions.Sessions.Get instead must check sessions.Session.IsImpersonation themselves.
+// The session ends along with the admin's session.
+func (a *Auth) Impersonate(p *permissions.Permissions, s *sessions.Sessions, token, key, id string) (itoken, ikey string, err error) {
+	var ss sessions.Session
+	if ss, err = s.GetSession(token, key); err != nil {
+		return
+	}
+
+	if ss.IsImpersonation() {
+		err = sessions.ErrNestedImpersonation
+		return
+	}
+
+	if ss.UUID == id || !p.Can(ss.UUID, ImpersonateResource, permissions.ActionWrite) ||
+		p.Can(id, ImpersonateResource, permissions.ActionWrite) {
+		err = ErrImpersonation
+		return
+	}
+
+	if _, err = a.GetUserByID(id); err != nil {
+		return
+	}
+
+	if itoken, ikey, err = s.Impersonate(token, key, id, DefaultImpersonationTTL); err != nil {
+		return
+	}
+
+	if err = a.record(AuditEvent{Type: AuditImpersonateStart, Actor: ss.UUID, Target: id}); err != nil {
+		s.EndImpersonation(itoken, ikey)
+		return "", "", err
+	}
+
+	return
+}
+
+// EndImpersonation ends the impersonation session token/key and returns the admin's own session token/key pair.
+func (a *Auth) EndImpersonation(s *sessions.Sessions, token, key string) (ptoken, pkey string, err error) {
+	var ss sessions.Session
+	if ss, err = s.GetSession(token, key); err != nil {
+		return
+	}
+
+	if !ss.IsImpersonation() {
+		err = sessions.ErrNotImpersonating
+		return
+	}
+
+	// the impersonation is over even if the admin's session is gone, so record it first.
+	if err = a.record(AuditEvent{Type: AuditImpersonateEnd, Actor: ss.Impersonator, Target: ss.UUID}); err != nil {
+		return
+	}
+
+	return s.EndImpersonation(token, key)
+}
+
+// SessionActor returns an Actor for the user of the session token/key.
+// If it is an impersonation session, the actor can't change credentials and its audit events are
+// recorded as the impersonator's.
+func (a *Auth) SessionActor(s *sessions.Sessions, token, key string, meta map[string]string) (*Actor, error) {
+	ss, err := s.GetSession(token, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Actor{a, auditInfo{actor: ss.UUID, meta: meta, impersonator: ss.Impersonator}}, nil
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PathDNA/auth/permissions"
+	"github.com/PathDNA/auth/sessions"
+)
+
+func TestImpersonate(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewWithOptions(filepath.Join(tmpPath, "db"), Options{Audit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	p, err := permissions.New(filepath.Join(tmpPath, "permissions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	s, err := sessions.New(filepath.Join(tmpPath, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	admin, err := a.CreateUser("support", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("customer", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.SetPermissions(ImpersonateResource, "support", permissions.ActionWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	atoken, akey := s.New(admin)
+	ctoken, ckey := s.New(id)
+
+	if _, _, err = a.Impersonate(p, s, atoken, akey, id); err != ErrImpersonation {
+		t.Fatalf("expected ErrImpersonation, got %v", err)
+	}
+
+	if err = p.AddGroup(admin, "support"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = a.Impersonate(p, s, ctoken, ckey, admin); err != ErrImpersonation {
+		t.Fatalf("expected ErrImpersonation, got %v", err)
+	}
+
+	itoken, ikey, err := a.Impersonate(p, s, atoken, akey, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := s.GetSession(itoken, ikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ss.UUID != id || ss.Impersonator != admin || ss.Expires.IsZero() {
+		t.Fatalf("unexpected session: %+v", ss)
+	}
+
+	ac, err := a.SessionActor(s, itoken, ikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ac.SetPassword(id, "hijacked"); err != ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating, got %v", err)
+	}
+
+	if err = ac.EditUserByID(id, func(u *User) error {
+		u.Username = "hijacked"
+		return nil
+	}); err != ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating, got %v", err)
+	}
+
+	if err = ac.EditUserByID(id, func(u *User) error {
+		u.Profile = map[string]string{"theme": "dark"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ptoken, pkey, err := a.EndImpersonation(s, itoken, ikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptoken != atoken || pkey != akey {
+		t.Fatal("expected the admin's session")
+	}
+
+	if _, err = s.Get(itoken, ikey); err != sessions.ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	evs, err := a.AuditLog(AuditFilter{UserID: admin, Types: []AuditType{AuditImpersonateStart, AuditEdit, AuditImpersonateEnd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evs) != 3 || evs[1].Target != id || evs[1].Meta["impersonating"] != id {
+		t.Fatalf("unexpected audit events: %+v", evs)
+	}
+}
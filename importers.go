@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+// CSVOptions are the options used by Auth.ImportCSV.
+type CSVOptions struct {
+	Conflict ConflictPolicy
+
+	// Header skips the first row.
+	Header bool
+
+	// Plaintext means the password column holds plain-text passwords that will be hashed with bcrypt,
+	// otherwise it must hold a hash supported by IsSupportedHash.
+	Plaintext bool
+}
+
+type credential struct {
+	line     int
+	username string
+	hash     string
+}
+
+// ImportHtpasswd imports the users of an Apache htpasswd file.
+// bcrypt, APR1-MD5 and {SHA} hashes are stored as-is and replaced with bcrypt on the user's next Login.
+// Imported users are active.
+func (a *Auth) ImportHtpasswd(r io.Reader, policy ConflictPolicy) (st ImportStats, err error) {
+	var creds []credential
+	if err = scanLines(r, func(ln int, line string) error {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("line %d: %w", ln, ErrInvalidImport)
+		}
+
+		if !IsSupportedHash(parts[1]) {
+			return fmt.Errorf("line %d: %w", ln, ErrUnsupportedHash)
+		}
+
+		creds = append(creds, credential{ln, parts[0], parts[1]})
+		return nil
+	}); err != nil {
+		return
+	}
+
+	err = a.importCredentials(creds, policy, &st)
+	return
+}
+
+// ImportShadow imports the users of an /etc/shadow style file, SHA-512 and SHA-256 crypt hashes are
+// stored as-is and replaced with bcrypt on the user's next Login.
+// Locked accounts and accounts without a password are skipped. Imported users are active.
+func (a *Auth) ImportShadow(r io.Reader, policy ConflictPolicy) (st ImportStats, err error) {
+	var creds []credential
+	if err = scanLines(r, func(ln int, line string) error {
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || parts[0] == "" {
+			return fmt.Errorf("line %d: %w", ln, ErrInvalidImport)
+		}
+
+		if hash := parts[1]; hash == "" || hash == "*" || hash[0] == '!' {
+			st.Skipped++
+			return nil
+		}
+
+		if !IsSupportedHash(parts[1]) {
+			return fmt.Errorf("line %d: %w", ln, ErrUnsupportedHash)
+		}
+
+		creds = append(creds, credential{ln, parts[0], parts[1]})
+		return nil
+	}); err != nil {
+		return
+	}
+
+	err = a.importCredentials(creds, policy, &st)
+	return
+}
+
+// ImportCSV imports users from CSV rows of username,password, any extra columns are ignored.
+// Imported users are active.
+func (a *Auth) ImportCSV(r io.Reader, opts CSVOptions) (st ImportStats, err error) {
+	var (
+		cr    = csv.NewReader(r)
+		creds []credential
+	)
+
+	cr.FieldsPerRecord = -1
+	for ln := 1; ; ln++ {
+		var row []string
+		if row, err = cr.Read(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		if ln == 1 && opts.Header {
+			continue
+		}
+
+		if len(row) < 2 || row[0] == "" || row[1] == "" {
+			err = fmt.Errorf("line %d: %w", ln, ErrInvalidImport)
+			return
+		}
+
+		c := credential{ln, row[0], row[1]}
+		if opts.Plaintext {
+			// hash outside the db lock
+			if c.hash, err = HashPassword(c.hash); err != nil {
+				return
+			}
+		} else if !IsSupportedHash(c.hash) {
+			err = fmt.Errorf("line %d: %w", ln, ErrUnsupportedHash)
+			return
+		}
+
+		creds = append(creds, c)
+	}
+
+	err = a.importCredentials(creds, opts.Conflict, &st)
+	return
+}
+
+// importCredentials creates or updates all the users in a single transaction, they are all validated first.
+func (a *Auth) importCredentials(creds []credential, policy ConflictPolicy, st *ImportStats) error {
+	var (
+		now = time.Now().Unix()
+		us  = make([]User, len(creds))
+	)
+
+	for i, c := range creds {
+		us[i] = User{
+			Username: c.username,
+			Password: c.hash,
+			Status:   StatusActive,
+
+			PasswordImported: NeedsRehash(c.hash),
+
+			CreatedTS:     now,
+			LastUpdatedTS: now,
+
+			SchemaVersion: a.migrations.Version(),
+		}
+
+		if err := us[i].Validate(); err != nil {
+			return fmt.Errorf("line %d: %w", c.line, err)
+		}
+	}
+
+	return a.update(func(tx turtleDB.Txn) error {
+		var (
+			loginsB, _ = tx.Get("logins")
+			usersB, _  = tx.Get("users")
+		)
+
+		for i, c := range creds {
+			if oid, _ := GetUserIDTx(tx, c.username); oid != "" {
+				switch policy {
+				case ConflictSkip:
+					st.Skipped++
+					continue
+				case ConflictFail:
+					return fmt.Errorf("line %d: %w: %s", c.line, ErrUserExists, c.username)
+				}
+
+				if err := editUserRecordTx(tx, oid, func(u *User) error {
+					u.Password = c.hash
+					return nil
+				}, NeedsRehash(c.hash)); err != nil {
+					return fmt.Errorf("line %d: %w", c.line, err)
+				}
+
+				st.Imported++
+				continue
+			}
+
+			u := us[i]
+			id, err := a.nextID(tx, "users")
+			if err != nil {
+				return err
+			}
+			u.ID = id
+
+			if err = usersB.Put(u.ID, u); err != nil {
+				return err
+			}
+
+			if err = loginsB.Put(u.Username, u.ID); err != nil {
+				return err
+			}
+
+			st.Imported++
+		}
+
+		return nil
+	})
+}
+
+// scanLines calls fn for every line that isn't empty or a comment.
+func scanLines(r io.Reader, fn func(ln int, line string) error) error {
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if err := fn(ln, line); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestForeignHashes(t *testing.T) {
+	tests := []struct {
+		hash, password string
+	}{
+		{"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1", "password"},
+		{"$1$abcdefgh$G//4keteveJp0qb8z2DxG/", "password"},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"},
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+			"a very much longer text to encrypt.  This one even stretches over morethan one line."},
+	}
+
+	for _, tc := range tests {
+		if !IsForeignHash(tc.hash) {
+			t.Errorf("%s: expected a foreign hash", tc.hash)
+		}
+
+		if !CheckPassword(tc.hash, tc.password) {
+			t.Errorf("%s: password doesn't match", tc.hash)
+		}
+
+		if CheckPassword(tc.hash, tc.password+"x") {
+			t.Errorf("%s: wrong password matches", tc.hash)
+		}
+	}
+
+	// the rounds are capped so a crafted hash can't keep a login busy
+	crafted := "$6$rounds=999999999$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if IsForeignHash(crafted) || CheckPassword(crafted, "Hello world!") {
+		t.Error("expected the rounds to be rejected")
+	}
+
+	// new passwords which look like foreign hashes are plain text
+	u := User{Password: "$1$a$b", Status: StatusActive}
+	if err := u.Validate(); err != ErrPlainPassword {
+		t.Fatalf("expected ErrPlainPassword, got %v", err)
+	}
+
+	if err := u.UpdatePassword(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsHashedPass(u.Password) || !u.PasswordsMatch("$1$a$b") {
+		t.Fatalf("expected a bcrypt hash of the plain-text password: %s", u.Password)
+	}
+}
+
+func TestImporters(t *testing.T) {
+	a, cleanupFn, err := newTempDB(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupFn()
+
+	b, err := bcrypt.GenerateFromPassword([]byte("slimer"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypt2y := "$2y$" + string(b[4:])
+
+	htpasswd := `# ghostbusters
+peter:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1
+ray:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+egon:` + bcrypt2y + `
+`
+
+	st, err := a.ImportHtpasswd(strings.NewReader(htpasswd), ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Imported != 3 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	shadow := `root:*:17000:0:99999:7:::
+locked:!$6$saltstring$svn8:17000:0:99999:7:::
+winston:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1:17000:0:99999:7:::
+`
+
+	if st, err = a.ImportShadow(strings.NewReader(shadow), ConflictFail); err != nil {
+		t.Fatal(err)
+	} else if st.Imported != 1 || st.Skipped != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	csvData := "username,password\njanine,whoyougonnacall\npeter,newpassword\n"
+	if _, err = a.ImportCSV(strings.NewReader(csvData), CSVOptions{Header: true, Plaintext: true}); err == nil {
+		t.Fatal("expected the existing user to fail the import")
+	}
+
+	if _, err = a.GetUserByName("janine"); err == nil {
+		t.Fatal("expected the failed import to be rolled back")
+	}
+
+	if st, err = a.ImportCSV(strings.NewReader(csvData), CSVOptions{Header: true, Plaintext: true, Conflict: ConflictSkip}); err != nil {
+		t.Fatal(err)
+	} else if st.Imported != 1 || st.Skipped != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if _, err = a.ImportCSV(strings.NewReader("dana,plain\n"), CSVOptions{}); err == nil {
+		t.Fatal("expected a plain-text password to be rejected")
+	}
+
+	// every row is validated before any is written
+	badName := "dana,slimer\nacme\x00peter,slimer\n"
+	if _, err = a.ImportCSV(strings.NewReader(badName), CSVOptions{Plaintext: true, Conflict: ConflictOverwrite}); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+
+	if _, err = a.GetUserByName("dana"); err == nil {
+		t.Fatal("expected the failed import to be rolled back")
+	}
+
+	// only the importers can store a foreign hash
+	peter, err := a.GetUserByName("peter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.EditUserByID(peter.ID, func(u *User) error {
+		u.Password = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+		return nil
+	}); err != ErrPlainPassword {
+		t.Fatalf("expected ErrPlainPassword, got %v", err)
+	}
+
+	if err = a.EditUserByID(peter.ID, func(u *User) error {
+		u.ExpiresTS = 0
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for username, password := range map[string]string{
+		"peter":   "password",
+		"ray":     "secret",
+		"egon":    "slimer",
+		"winston": "Hello world!",
+		"janine":  "whoyougonnacall",
+	} {
+		if _, err = a.Login(username, password+"x"); err != ErrInvalidLogin {
+			t.Fatalf("%s: expected ErrInvalidLogin, got %v", username, err)
+		}
+
+		u, err := a.Login(username, password)
+		if err != nil {
+			t.Fatalf("%s: %v", username, err)
+		}
+
+		if u.Status != StatusActive || !IsHashedPass(u.Password) || u.PasswordImported {
+			t.Fatalf("%s: expected an active user with a bcrypt hash: %+v", username, u)
+		}
+
+		if u, err = a.GetUserByName(username); err != nil {
+			t.Fatal(err)
+		} else if !IsHashedPass(u.Password) || !u.PasswordsMatch(password) {
+			t.Fatalf("%s: expected the rehashed password to be stored", username)
+		}
+	}
+}
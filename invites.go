@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/PathDNA/auth/permissions"
+	"github.com/PathDNA/turtleDB"
+)
+
+const invitesBkt = "invites"
+
+// InviteOptions are the settings of a new invite code, see Auth.CreateInvite.
+type InviteOptions struct {
+	// MaxUses is how many users can sign up with the code, it defaults to 1.
+	MaxUses int
+	// TTL is how long the code is valid for, zero means it never expires.
+	TTL time.Duration
+	// Groups are the permissions groups the users who sign up with the code are added to.
+	Groups []string
+	// Inviter is the ID of the user who created the code.
+	Inviter string
+}
+
+// InviteCode is an invite code, it is stored by the hash of the code and its users are recorded in UsedBy.
+type InviteCode struct {
+	// Code is only set on the InviteCode returned by Auth.CreateInvite, it is not stored.
+	Code string `json:"-"`
+	// ID is the hash of the code, see Auth.RevokeInvite.
+	ID string `json:"id"`
+
+	Inviter string   `json:"inviter,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+
+	MaxUses int      `json:"maxUses"`
+	UsedBy  []string `json:"usedBy,omitempty"`
+
+	CreatedTS int64 `json:"created"`
+	// ExpiresTS is when the code expires in unix seconds, zero means never.
+	ExpiresTS int64 `json:"expires,omitempty"`
+	// RevokedTS is when the code was revoked in unix seconds, zero if it wasn't.
+	RevokedTS int64 `json:"revoked,omitempty"`
+}
+
+// Uses returns how many users signed up with the code.
+func (ic *InviteCode) Uses() int { return len(ic.UsedBy) }
+
+// Valid returns nil if the code can be used, otherwise the reason it can't.
+func (ic *InviteCode) Valid() error {
+	switch {
+	case ic.RevokedTS != 0:
+		return ErrInviteRevoked
+	case ic.ExpiresTS != 0 && time.Now().Unix() >= ic.ExpiresTS:
+		return ErrInviteExpired
+	case ic.Uses() >= ic.MaxUses:
+		return ErrInviteUsedUp
+	}
+	return nil
+}
+
+// inviteID returns the ID an invite code is stored under.
+func inviteID(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateInvite creates a new invite code and returns it, only the returned InviteCode has the code.
+func (a *Auth) CreateInvite(opts InviteOptions) (ic InviteCode, err error) {
+	if opts.MaxUses <= 0 {
+		opts.MaxUses = 1
+	}
+
+	now := time.Now()
+	ic = InviteCode{
+		Code:      RandomToken(12, true),
+		Inviter:   opts.Inviter,
+		Groups:    append([]string(nil), opts.Groups...),
+		MaxUses:   opts.MaxUses,
+		CreatedTS: now.Unix(),
+	}
+
+	ic.ID = inviteID(ic.Code)
+
+	if opts.TTL > 0 {
+		ic.ExpiresTS = now.Add(opts.TTL).Unix()
+	}
+
+	if err = a.update(func(tx turtleDB.Txn) error {
+		b, err := tx.Get(invitesBkt)
+		if err != nil {
+			return err
+		}
+
+		// the code isn't kept in memory either
+		stored := ic
+		stored.Code = ""
+		return b.Put(ic.ID, stored)
+	}); err != nil {
+		return InviteCode{}, err
+	}
+
+	return
+}
+
+// GetInvite returns an invite code.
+func (a *Auth) GetInvite(code string) (ic InviteCode, err error) {
+	err = a.read(func(tx turtleDB.Txn) error {
+		ic, err = getInviteTx(tx, inviteID(code))
+		return err
+	})
+	return
+}
+
+// Invites returns all the invite codes without their codes, including the used up, expired and revoked ones,
+// oldest first.
+func (a *Auth) Invites() (ics []InviteCode, err error) {
+	err = a.read(func(tx turtleDB.Txn) error {
+		b, err := tx.Get(invitesBkt)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(_ string, v turtleDB.Value) error {
+			ic, ok := v.(InviteCode)
+			if !ok {
+				return unexpectedTypeError(v)
+			}
+			ics = append(ics, ic)
+			return nil
+		})
+	})
+
+	sort.Slice(ics, func(i, j int) bool {
+		if ics[i].CreatedTS != ics[j].CreatedTS {
+			return ics[i].CreatedTS < ics[j].CreatedTS
+		}
+		return ics[i].ID < ics[j].ID
+	})
+	return
+}
+
+// RevokeInvite revokes the invite code of id, see InviteCode.ID, it is kept for attribution.
+func (a *Auth) RevokeInvite(id string) error {
+	return a.update(func(tx turtleDB.Txn) error {
+		ic, err := getInviteTx(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if ic.RevokedTS != 0 {
+			return nil
+		}
+
+		ic.RevokedTS = time.Now().Unix()
+		b, _ := tx.Get(invitesBkt)
+		return b.Put(id, ic)
+	})
+}
+
+// CreateUserWithInvite is Auth.CreateUser for invite-only signups, a use of the code is consumed in the same
+// transaction as the creation of the user. If p isn't nil, the user is added to the code's groups before
+// the transaction is committed, and removed from them if it isn't.
+func (a *Auth) CreateUserWithInvite(p *permissions.Permissions, code, username, password string) (id string, err error) {
+	icID := inviteID(code)
+
+	var ic InviteCode
+	if ic, err = a.GetInvite(code); err != nil {
+		return
+	}
+
+	var (
+		ai = auditInfo{actor: ic.Inviter, meta: map[string]string{"invite": icID}}
+
+		uid    string
+		groups []string
+	)
+
+	if id, err = a.createUserTx(ai, "", "", username, password, func(tx turtleDB.Txn, u *User) error {
+		// the code may have been used since it was read
+		ic, err := getInviteTx(tx, icID)
+		if err != nil {
+			return err
+		}
+
+		if err = ic.Valid(); err != nil {
+			return err
+		}
+
+		ic.UsedBy = append(ic.UsedBy[:ic.Uses():ic.Uses()], u.ID)
+		b, _ := tx.Get(invitesBkt)
+		if err = b.Put(icID, ic); err != nil {
+			return err
+		}
+
+		if p == nil || len(ic.Groups) == 0 {
+			return nil
+		}
+
+		switch err = p.AddGroup(u.ID, ic.Groups...); err {
+		case nil:
+			uid, groups = u.ID, ic.Groups
+		case permissions.ErrPermissionsUnchanged:
+			err = nil
+		}
+		return err
+	}); err != nil && groups != nil {
+		p.RemoveGroup(uid, groups...)
+	}
+
+	return
+}
+
+func getInviteTx(tx turtleDB.Txn, code string) (ic InviteCode, err error) {
+	b, err := tx.Get(invitesBkt)
+	if err != nil {
+		return
+	}
+
+	v, err := b.Get(code)
+	if err != nil {
+		if err == turtleDB.ErrKeyDoesNotExist {
+			err = ErrInviteNotFound
+		}
+		return
+	}
+
+	ic, ok := v.(InviteCode)
+	if !ok {
+		err = unexpectedTypeError(v)
+	}
+	return
+}
+
+func marshalInviteCode(v turtleDB.Value) ([]byte, error) {
+	ic, ok := v.(InviteCode)
+	if !ok {
+		return nil, unexpectedTypeError(v)
+	}
+	return json.Marshal(ic)
+}
+
+func unmarshalInviteCode(b []byte) (turtleDB.Value, error) {
+	var ic InviteCode
+	if err := json.Unmarshal(b, &ic); err != nil {
+		return nil, err
+	}
+	return ic, nil
+}
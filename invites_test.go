@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PathDNA/auth/permissions"
+)
+
+func TestInvites(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewWithOptions(filepath.Join(tmpPath, "db"), Options{Audit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	p, err := permissions.New(filepath.Join(tmpPath, "permissions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	admin, err := a.CreateUser("admin", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic, err := a.CreateInvite(InviteOptions{MaxUses: 2, Groups: []string{"beta"}, Inviter: admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.CreateUserWithInvite(p, "nope", "alice", "password"); err != ErrInviteNotFound {
+		t.Fatalf("expected ErrInviteNotFound, got %v", err)
+	}
+
+	alice, err := a.CreateUserWithInvite(p, ic.Code, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Has(alice, "beta") {
+		t.Fatal("alice wasn't added to the invite's groups")
+	}
+
+	// a failed signup doesn't consume a use
+	if _, err = a.CreateUserWithInvite(p, ic.Code, "alice", "password"); err != ErrUserExists {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+
+	bob, err := a.CreateUserWithInvite(nil, ic.Code, "bob", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.CreateUserWithInvite(p, ic.Code, "carol", "password"); err != ErrInviteUsedUp {
+		t.Fatalf("expected ErrInviteUsedUp, got %v", err)
+	}
+
+	if _, err = a.GetUserByName("carol"); err == nil {
+		t.Fatal("carol was created with a used up code")
+	}
+
+	code := ic.Code
+	if ic, err = a.GetInvite(code); err != nil {
+		t.Fatal(err)
+	}
+
+	if ic.Uses() != 2 || ic.UsedBy[0] != alice || ic.UsedBy[1] != bob {
+		t.Fatalf("unexpected invite: %+v", ic)
+	}
+
+	expired, err := a.CreateInvite(InviteOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := a.CreateInvite(InviteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.RevokeInvite(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.CreateUserWithInvite(p, revoked.Code, "carol", "password"); err != ErrInviteRevoked {
+		t.Fatalf("expected ErrInviteRevoked, got %v", err)
+	}
+
+	time.Sleep(time.Second)
+	if _, err = a.CreateUserWithInvite(p, expired.Code, "carol", "password"); err != ErrInviteExpired {
+		t.Fatalf("expected ErrInviteExpired, got %v", err)
+	}
+
+	ics, err := a.Invites()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ics) != 3 {
+		t.Fatalf("unexpected invites: %+v", ics)
+	}
+
+	// only the hashes of the codes are stored
+	for _, ic := range ics {
+		if ic.Code != "" || ic.ID == code {
+			t.Fatalf("unexpected invites: %+v", ics)
+		}
+	}
+
+	evs, err := a.AuditLog(AuditFilter{UserID: admin, Types: []AuditType{AuditCreate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin's own creation and the two signups
+	if len(evs) != 3 || evs[1].Target != alice || evs[1].Actor != admin || evs[1].Meta["invite"] != ic.ID {
+		t.Fatalf("unexpected audit events: %+v", evs)
+	}
+}
@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	keyCheckName   = "keycheck.json"
+	rotatedMarker  = "rotated"
+	rotatingSuffix = ".key-rotation"
+	oldSuffix      = ".key-rotation-old"
+
+	// plainFingerprint is the fingerprint of an unencrypted store.
+	plainFingerprint = "plain"
+)
+
+var keyCheckMsg = []byte("PathDNA/auth key check")
+
+// Key is an encryption key/iv pair, a nil Key means the store isn't encrypted.
+type Key struct {
+	Key []byte
+	IV  []byte
+}
+
+// fingerprint returns a value that identifies the key without revealing it.
+func (k Key) fingerprint() string {
+	if k.Key == nil {
+		return plainFingerprint
+	}
+
+	mac := hmac.New(sha256.New, k.Key)
+	mac.Write(k.IV)
+	mac.Write(keyCheckMsg)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+type keyCheck struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// selectKey returns the key matching the key check file of the store at path.
+// A new store uses the first key, a store created before key checks existed uses the first key probe
+// can open it with, ErrWrongKey is returned if there is none.
+func selectKey(path string, keys []Key, probe func(k Key) error) (k Key, err error) {
+	var kc keyCheck
+	if kc, err = readKeyCheck(path); os.IsNotExist(err) {
+		if !hasData(path) {
+			return keys[0], nil
+		}
+
+		for _, k = range keys {
+			if probe(k) == nil {
+				return k, nil
+			}
+		}
+
+		return Key{}, ErrWrongKey
+	} else if err != nil {
+		return
+	}
+
+	for _, k = range keys {
+		if k.fingerprint() == kc.Fingerprint {
+			return k, nil
+		}
+	}
+
+	return Key{}, ErrWrongKey
+}
+
+// hasData returns true if there is anything but a key check file at path.
+func hasData(path string) bool {
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false
+	}
+
+	for _, fi := range fis {
+		if fi.Name() != keyCheckName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeKey tries to load the store at path with k.
+func (a *Auth) probeKey(path string) func(k Key) error {
+	return func(k Key) error {
+		t, err := a.open(path, k)
+		if err != nil {
+			return err
+		}
+
+		return t.Close()
+	}
+}
+
+func readKeyCheck(path string) (kc keyCheck, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filepath.Join(path, keyCheckName)); err != nil {
+		return
+	}
+
+	err = json.Unmarshal(b, &kc)
+	return
+}
+
+func writeKeyCheck(path string, k Key) error {
+	b, err := json.Marshal(keyCheck{k.fingerprint()})
+	if err != nil {
+		return err
+	}
+
+	fp := filepath.Join(path, keyCheckName)
+	if old, err := ioutil.ReadFile(fp); err == nil && bytes.Equal(old, b) {
+		return nil
+	}
+
+	return writeFileSync(fp, b)
+}
+
+// RotateKey re-encrypts the store with newKey/newIV, oldKey/oldIV must be the current key.
+// A nil key means no encryption, so it can also be used to encrypt or decrypt an existing store.
+//
+// The data is copied to a staging store next to path which is swapped in once it is complete,
+// all other operations block until the rotation is done.
+// If the process crashes before the swap, the staging store is discarded on the next open and RotateKey
+// can simply be called again, if it crashes after, the swap is finished on the next open.
+// Either way the store may be encrypted with either key, so it should be opened with both, see Options.Keyring.
+func (a *Auth) RotateKey(oldKey, oldIV, newKey, newIV []byte) (err error) {
+	var (
+		oldK = Key{oldKey, oldIV}
+		newK = Key{newKey, newIV}
+	)
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if oldK.fingerprint() != a.key.fingerprint() {
+		return ErrWrongKey
+	}
+
+	staging := a.path + rotatingSuffix
+	if err = a.stageRotation(staging, newK); err != nil {
+		os.RemoveAll(staging)
+		return
+	}
+
+	if err = a.t.Close(); err != nil {
+		return
+	}
+
+	ferr := finishRotation(a.path)
+
+	if err = a.reopen(newK, oldK); err != nil {
+		// don't leave a.t closed if the old store is still usable
+		if t, oerr := a.open(a.path, oldK); oerr == nil {
+			a.t, a.key = t, oldK
+		}
+		return
+	}
+
+	return ferr
+}
+
+// reopen opens whichever store ended up at a.path after a rotation, recovering from a partial swap if needed.
+// it must be called with a.mux locked.
+func (a *Auth) reopen(keys ...Key) (err error) {
+	if err = recoverRotation(a.path); err != nil {
+		return
+	}
+
+	var k Key
+	if k, err = selectKey(a.path, keys, a.probeKey(a.path)); err != nil {
+		return
+	}
+
+	var t *turtleDB.Turtle
+	if t, err = a.open(a.path, k); err != nil {
+		return
+	}
+
+	a.t, a.key = t, k
+	return
+}
+
+// stageRotation copies everything to a new store at staging encrypted with k and marks it as complete.
+// it must be called with a.mux locked.
+func (a *Auth) stageRotation(staging string, k Key) (err error) {
+	if err = os.RemoveAll(staging); err != nil {
+		return
+	}
+
+	var st *turtleDB.Turtle
+	if st, err = a.open(staging, k); err != nil {
+		return
+	}
+
+	if err = a.t.Read(func(src turtleDB.Txn) error {
+		return st.Update(func(dst turtleDB.Txn) error {
+			for _, name := range buckets {
+				sb, err := src.Get(name)
+				if err != nil {
+					return err
+				}
+
+				db, err := dst.Create(name)
+				if err != nil {
+					return err
+				}
+
+				if err = sb.ForEach(func(key string, val turtleDB.Value) error {
+					return db.Put(key, val)
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		st.Close()
+		return
+	}
+
+	if err = st.Close(); err != nil {
+		return
+	}
+
+	if err = writeKeyCheck(staging, k); err != nil {
+		return
+	}
+
+	// this is the commit point, once the marker exists the staging store replaces the current one.
+	return writeFileSync(filepath.Join(staging, rotatedMarker), nil)
+}
+
+// finishRotation swaps a complete staging store with the store at path.
+func finishRotation(path string) (err error) {
+	var (
+		staging = path + rotatingSuffix
+		old     = path + oldSuffix
+	)
+
+	if exists(path) {
+		if err = os.RemoveAll(old); err != nil {
+			return
+		}
+
+		if err = os.Rename(path, old); err != nil {
+			return
+		}
+	}
+
+	if err = os.Rename(staging, path); err != nil {
+		return
+	}
+
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return
+	}
+
+	if err = os.Remove(filepath.Join(path, rotatedMarker)); err != nil {
+		return
+	}
+
+	return os.RemoveAll(old)
+}
+
+// recoverRotation finishes or discards a RotateKey that was interrupted by a crash.
+func recoverRotation(path string) error {
+	staging := path + rotatingSuffix
+	switch {
+	case exists(filepath.Join(staging, rotatedMarker)):
+		return finishRotation(path)
+	case exists(filepath.Join(path, rotatedMarker)):
+		// crashed after the swap, before the cleanup
+		if err := os.Remove(filepath.Join(path, rotatedMarker)); err != nil {
+			return err
+		}
+		return os.RemoveAll(path + oldSuffix)
+	case exists(staging):
+		return os.RemoveAll(staging)
+	}
+
+	return nil
+}
+
+func writeFileSync(fp string, b []byte) (err error) {
+	var f *os.File
+	if f, err = os.Create(fp); err != nil {
+		return
+	}
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func exists(fp string) bool {
+	_, err := os.Stat(fp)
+	return err == nil
+}
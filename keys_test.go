@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		k1   = Key{[]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef")}
+		k2   = Key{[]byte("fedcba9876543210fedcba9876543210"), []byte("fedcba9876543210")}
+	)
+
+	a, err := NewEncrypted(path, k1.Key, k1.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("gbusters", "who are you gonna call")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.RotateKey(k2.Key, k2.IV, k1.Key, k1.IV); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+
+	if err = a.RotateKey(k1.Key, k1.IV, k2.Key, k2.IV); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if _, err = NewEncrypted(path, k1.Key, k1.IV); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+
+	if _, err = New(path); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+
+	// simulate a crash right after the staging store was committed
+	if a, err = NewWithOptions(path, Options{Key: k1.Key, IV: k1.IV, Keyring: []Key{k2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.mux.Lock()
+	err = a.stageRotation(path+rotatingSuffix, k1)
+	a.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if a, err = NewWithOptions(path, Options{Key: k2.Key, IV: k2.IV, Keyring: []Key{k1}}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if a.key.fingerprint() != k1.fingerprint() {
+		t.Fatal("expected the interrupted rotation to be finished")
+	}
+
+	if exists(path+rotatingSuffix) || exists(path+oldSuffix) {
+		t.Fatal("expected the rotation leftovers to be removed")
+	}
+
+	if _, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectKeyWithoutKeyCheck(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		k1   = Key{[]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef")}
+		k2   = Key{[]byte("fedcba9876543210fedcba9876543210"), []byte("fedcba9876543210")}
+
+		// only k2 can load the store
+		probe = func(k Key) error {
+			if k.fingerprint() != k2.fingerprint() {
+				return ErrWrongKey
+			}
+			return nil
+		}
+	)
+
+	// a new store uses the first key
+	if k, err := selectKey(path, []Key{k1, k2}, probe); err != nil || k.fingerprint() != k1.fingerprint() {
+		t.Fatalf("expected k1, got %v", err)
+	}
+
+	a, err := NewEncrypted(path, k2.Key, k2.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// a store created before key checks existed
+	if err = os.Remove(filepath.Join(path, keyCheckName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if k, err := selectKey(path, []Key{k1, k2}, probe); err != nil || k.fingerprint() != k2.fingerprint() {
+		t.Fatalf("expected k2, got %v", err)
+	}
+
+	if _, err = selectKey(path, []Key{k1}, probe); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+
+	if a, err = NewWithOptions(path, Options{Key: k2.Key, IV: k2.IV, Keyring: []Key{k1}}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if !exists(filepath.Join(path, keyCheckName)) {
+		t.Fatal("expected the key check to be written")
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+// DefaultMigrateBatchSize is the number of users rewritten per transaction by MigrateAll if batchSize is <= 0.
+const DefaultMigrateBatchSize = 100
+
+// MigrationFn upgrades a stored user record by one schema version.
+// rec is the decoded JSON object of the user, numbers are decoded as json.Number.
+type MigrationFn func(rec map[string]interface{}) error
+
+// Migrations is an ordered registry of user schema migrations.
+// Records without a schema version are version 0, the first registered func upgrades them to version 1 and so on.
+type Migrations struct {
+	fns []MigrationFn
+}
+
+// Register appends a migration from the current schema version to the next one.
+func (m *Migrations) Register(fn MigrationFn) *Migrations {
+	m.fns = append(m.fns, fn)
+	return m
+}
+
+// Version returns the current schema version, which is the number of registered migrations.
+func (m *Migrations) Version() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.fns)
+}
+
+// migrate applies all the needed migrations to the raw user json and returns the upgraded json.
+func (m *Migrations) migrate(p []byte) ([]byte, error) {
+	var hdr struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+
+	if err := json.Unmarshal(p, &hdr); err != nil {
+		return nil, err
+	}
+
+	cur := m.Version()
+	switch v := hdr.SchemaVersion; {
+	case v == cur:
+		return p, nil
+	case v > cur:
+		return nil, fmt.Errorf("%w: stored %d, supported %d", ErrSchemaVersion, v, cur)
+	}
+
+	var (
+		rec = map[string]interface{}{}
+		dec = json.NewDecoder(bytes.NewReader(p))
+	)
+
+	dec.UseNumber()
+	if err := dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+
+	for v := hdr.SchemaVersion; v < cur; v++ {
+		if err := m.fns[v](rec); err != nil {
+			return nil, fmt.Errorf("migration %d -> %d: %w", v, v+1, err)
+		}
+	}
+
+	rec["schemaVersion"] = cur
+	return json.Marshal(rec)
+}
+
+// MigrateAll rewrites every user with the current schema version, batchSize users per transaction.
+// Users are migrated in memory when they are loaded, this persists them so the migrations don't have to run again.
+func (a *Auth) MigrateAll(batchSize int) (n int, err error) {
+	if batchSize <= 0 {
+		batchSize = DefaultMigrateBatchSize
+	}
+
+	var ids []string
+	if err = a.read(func(tx turtleDB.Txn) error {
+		usersB, err := tx.Get("users")
+		if err != nil {
+			return err
+		}
+
+		return usersB.ForEach(func(id string, _ turtleDB.Value) error {
+			ids = append(ids, id)
+			return nil
+		})
+	}); err != nil {
+		return
+	}
+
+	version := a.migrations.Version()
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		ids = ids[len(batch):]
+
+		var cnt int
+		if err = a.update(func(tx turtleDB.Txn) error {
+			usersB, err := tx.Get("users")
+			if err != nil {
+				return err
+			}
+
+			for _, id := range batch {
+				u, err := GetUserByIDTx(tx, id)
+				switch err {
+				case nil:
+				case ErrUserNotFound, turtleDB.ErrKeyDoesNotExist:
+					// deleted since we listed the ids
+					continue
+				default:
+					return err
+				}
+
+				u.SchemaVersion = version
+				if err = usersB.Put(id, u); err != nil {
+					return err
+				}
+				cnt++
+			}
+
+			return nil
+		}); err != nil {
+			return
+		}
+
+		n += cnt
+	}
+
+	return
+}
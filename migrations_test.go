@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type profileV1 struct {
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+	Phone string `json:"phone,omitempty"`
+}
+
+func TestMigrations(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewTyped[Profile](tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("gbusters", "who are you gonna call")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.EditUserByID(id, func(u *TypedUser[Profile]) error {
+		u.Profile = &Profile{Name: "Peter Venkman", Phone: "1-800-555-2368"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	var calls int
+	m := new(Migrations).Register(func(rec map[string]interface{}) error {
+		calls++
+		p, _ := rec["profile"].(map[string]interface{})
+		name, _ := p["name"].(string)
+		parts := strings.SplitN(name, " ", 2)
+		p["first"], p["last"] = parts[0], parts[1]
+		delete(p, "name")
+		return nil
+	})
+
+	ta, err := NewTypedWithOptions[profileV1](tmpPath, Options{Migrations: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tu, err := ta.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tu.SchemaVersion != 1 || tu.Profile.First != "Peter" || tu.Profile.Last != "Venkman" || tu.Profile.Phone != "1-800-555-2368" {
+		t.Fatalf("unexpected migrated user: %+v %+v", tu.User, tu.Profile)
+	}
+
+	if n, err := ta.MigrateAll(1); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1 migrated user, got %d", n)
+	}
+	ta.Close()
+
+	calls = 0
+	if ta, err = NewTypedWithOptions[profileV1](tmpPath, Options{Migrations: m}); err != nil {
+		t.Fatal(err)
+	}
+	ta.Close()
+
+	if calls != 0 {
+		t.Fatalf("expected the migrated users to be persisted, migration ran %d times", calls)
+	}
+
+	if _, err = New(tmpPath); !errors.Is(err, ErrSchemaVersion) {
+		t.Fatalf("expected %v, got %v", ErrSchemaVersion, err)
+	}
+}
@@ -0,0 +1,246 @@
+package orgs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/PathDNA/auth"
+	"github.com/PathDNA/turtleDB"
+)
+
+// Invite is a pending invitation to join an organization, it is stored by the hash of its token
+type Invite struct {
+	// Token is only set on the Invite returned by Orgs.Invite
+	Token string `json:"-"`
+
+	ID        string `json:"id"`
+	OrgID     string `json:"org"`
+	Email     string `json:"email"`
+	Role      Role   `json:"role"`
+	InvitedBy string `json:"invitedBy"`
+
+	CreatedTS int64 `json:"created"`
+	ExpiresTS int64 `json:"expires"`
+}
+
+// Expired will return if the invite is expired
+func (inv *Invite) Expired() bool {
+	return time.Now().Unix() >= inv.ExpiresTS
+}
+
+// inviteID will return the ID an invite token is stored under
+func inviteID(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Invite will create an invite to join an organization with the given role, the returned Invite's Token
+// is meant to be sent to the email address and passed to Accept, it is not stored.
+// Admins can invite members and the owner can also invite admins. A zero ttl means DefaultInviteTTL.
+func (o *Orgs) Invite(orgID, inviterID, email string, role Role, ttl time.Duration) (inv Invite, err error) {
+	if !role.isValid() || role == RoleOwner {
+		err = ErrInvalidRole
+		return
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+
+	now := time.Now()
+	inv = Invite{
+		Token:     auth.RandomToken(32, true),
+		OrgID:     orgID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: inviterID,
+		CreatedTS: now.Unix(),
+		ExpiresTS: now.Add(ttl).Unix(),
+	}
+	inv.ID = inviteID(inv.Token)
+
+	if err = o.db.Update(func(txn turtleDB.Txn) (err error) {
+		var org Org
+		if org, err = o.getOrg(txn, orgID); err != nil {
+			return
+		}
+
+		if !canManage(org.Role(inviterID), RoleMember, role) {
+			return ErrForbidden
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(invitesBkt); err != nil {
+			return
+		}
+
+		return bkt.Put(inv.ID, inv)
+	}); err != nil {
+		return Invite{}, err
+	}
+
+	return
+}
+
+// Accept will add userID to the organization of the invite token with the invite's role and return the organization.
+// Matching the user to the invite's email is left to the caller.
+func (o *Orgs) Accept(token, userID string) (org Org, err error) {
+	if _, err = o.a.GetUserByID(userID); err != nil {
+		return
+	}
+
+	id := inviteID(token)
+	var inv Invite
+	if err = o.db.Update(func(txn turtleDB.Txn) (err error) {
+		if inv, err = o.getInvite(txn, id); err != nil {
+			return
+		}
+
+		if inv.Expired() {
+			return ErrInviteExpired
+		}
+
+		if org, err = o.getOrg(txn, inv.OrgID); err != nil {
+			return
+		}
+
+		if org.Role(userID) != RoleNone {
+			return ErrAlreadyMember
+		}
+
+		org.Members[userID] = inv.Role
+		if err = o.putOrg(txn, org); err != nil {
+			return
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(invitesBkt); err != nil {
+			return
+		}
+
+		return bkt.Delete(id)
+	}); err != nil {
+		return Org{}, err
+	}
+
+	err = o.setGroups(org.ID, userID, inv.Role)
+	return
+}
+
+// RevokeInvite will delete a pending invite by its ID, the inviter and the organization's admins can revoke it
+func (o *Orgs) RevokeInvite(orgID, actorID, id string) (err error) {
+	return o.db.Update(func(txn turtleDB.Txn) (err error) {
+		var (
+			org Org
+			inv Invite
+		)
+
+		if org, err = o.getOrg(txn, orgID); err != nil {
+			return
+		}
+
+		if inv, err = o.getInvite(txn, id); err != nil {
+			return
+		}
+
+		if inv.OrgID != orgID {
+			return ErrInviteNotFound
+		}
+
+		if inv.InvitedBy != actorID && !canManage(org.Role(actorID), RoleMember, inv.Role) {
+			return ErrForbidden
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(invitesBkt); err != nil {
+			return
+		}
+
+		return bkt.Delete(id)
+	})
+}
+
+// Invites will return the pending invites of an organization, including expired ones
+func (o *Orgs) Invites(orgID string) (invs []Invite, err error) {
+	err = o.db.Read(func(txn turtleDB.Txn) (err error) {
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(invitesBkt); err != nil {
+			return
+		}
+
+		return bkt.ForEach(func(_ string, val turtleDB.Value) error {
+			inv, ok := val.(Invite)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+
+			if inv.OrgID == orgID {
+				invs = append(invs, inv)
+			}
+			return nil
+		})
+	})
+
+	return
+}
+
+// PurgeInvites will delete all the expired invites
+func (o *Orgs) PurgeInvites() (err error) {
+	return o.db.Update(func(txn turtleDB.Txn) error {
+		return o.deleteInvites(txn, func(inv Invite) bool { return inv.Expired() })
+	})
+}
+
+func (o *Orgs) deleteInvites(txn turtleDB.Txn, fn func(inv Invite) bool) (err error) {
+	var (
+		bkt turtleDB.Bucket
+		ids []string
+	)
+
+	if bkt, err = txn.Get(invitesBkt); err != nil {
+		return
+	}
+
+	if err = bkt.ForEach(func(id string, val turtleDB.Value) error {
+		if inv, ok := val.(Invite); ok && fn(inv) {
+			ids = append(ids, id)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		if err = bkt.Delete(id); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func marshalInvite(val turtleDB.Value) (b []byte, err error) {
+	var (
+		inv Invite
+		ok  bool
+	)
+
+	if inv, ok = val.(Invite); !ok {
+		err = turtleDB.ErrInvalidType
+		return
+	}
+
+	return json.Marshal(inv)
+}
+
+func unmarshalInvite(b []byte) (val turtleDB.Value, err error) {
+	var inv Invite
+	if err = json.Unmarshal(b, &inv); err != nil {
+		return
+	}
+
+	val = inv
+	return
+}
@@ -0,0 +1,130 @@
+package orgs
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+// Role represents the role of a member within an organization
+type Role uint8
+
+const (
+	// RoleNone represents a zero value, not a member
+	RoleNone Role = iota
+	// RoleMember represents a regular member
+	RoleMember
+	// RoleAdmin represents a member who can manage the other members
+	RoleAdmin
+	// RoleOwner represents the single owner of an organization
+	RoleOwner
+)
+
+var roleNames = [...]string{"", "member", "admin", "owner"}
+
+// String will return the name of the role, which is also used in its permissions group
+func (r Role) String() string {
+	if int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+
+	return "invalid"
+}
+
+func (r Role) isValid() bool {
+	return r >= RoleMember && r <= RoleOwner
+}
+
+// Group will return the permissions group every member of an organization belongs to
+func Group(orgID string) string {
+	return "org:" + orgID
+}
+
+// RoleGroup will return the permissions group of a role within an organization,
+// roles include the ones below them so an owner is also in the admin and member groups
+func RoleGroup(orgID string, r Role) string {
+	return Group(orgID) + ":" + r.String()
+}
+
+// groupsFor will return the permissions groups of a role within an organization
+func groupsFor(orgID string, r Role) (gs []string) {
+	if r == RoleNone {
+		return
+	}
+
+	gs = append(gs, Group(orgID))
+	for role := RoleMember; role <= r; role++ {
+		gs = append(gs, RoleGroup(orgID, role))
+	}
+
+	return
+}
+
+// isOrgGroup will return if a permissions group belongs to the organization
+func isOrgGroup(orgID, group string) bool {
+	g := Group(orgID)
+	return group == g || strings.HasPrefix(group, g+":")
+}
+
+// Org is an organization
+type Org struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Members is the role of every member by their Auth user ID
+	Members map[string]Role `json:"members"`
+
+	CreatedTS int64 `json:"created"`
+}
+
+// Owner will return the user ID of the owner
+func (o *Org) Owner() (id string) {
+	for uid, r := range o.Members {
+		if r == RoleOwner {
+			return uid
+		}
+	}
+
+	return
+}
+
+// Role will return the role of a user, RoleNone if they are not a member
+func (o *Org) Role(userID string) Role {
+	return o.Members[userID]
+}
+
+// Dup will return a copy of the organization
+func (o Org) Dup() Org {
+	members := make(map[string]Role, len(o.Members))
+	for uid, r := range o.Members {
+		members[uid] = r
+	}
+
+	o.Members = members
+	return o
+}
+
+func marshalOrg(val turtleDB.Value) (b []byte, err error) {
+	var (
+		o  Org
+		ok bool
+	)
+
+	if o, ok = val.(Org); !ok {
+		err = turtleDB.ErrInvalidType
+		return
+	}
+
+	return json.Marshal(o)
+}
+
+func unmarshalOrg(b []byte) (val turtleDB.Value, err error) {
+	var o Org
+	if err = json.Unmarshal(b, &o); err != nil {
+		return
+	}
+
+	val = o
+	return
+}
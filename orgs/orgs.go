@@ -0,0 +1,409 @@
+package orgs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/PathDNA/auth"
+	"github.com/PathDNA/auth/permissions"
+	"github.com/PathDNA/turtleDB"
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrOrgNotFound is returned when an organization doesn't exist
+	ErrOrgNotFound = errors.Error("organization not found")
+	// ErrInvalidName is returned when an organization is created with an empty name
+	ErrInvalidName = errors.Error("invalid organization name")
+	// ErrInvalidRole is returned when a role isn't one of the Role constants, or is RoleOwner where it can't be granted
+	ErrInvalidRole = errors.Error("invalid role")
+	// ErrNotMember is returned when a user isn't a member of the organization
+	ErrNotMember = errors.Error("not a member of the organization")
+	// ErrAlreadyMember is returned when a user is already a member of the organization
+	ErrAlreadyMember = errors.Error("already a member of the organization")
+	// ErrForbidden is returned when the acting user's role doesn't allow the action
+	ErrForbidden = errors.Error("forbidden")
+	// ErrOwner is returned when the owner would be removed or demoted, ownership has to be transferred first
+	ErrOwner = errors.Error("the owner can't be removed, transfer the ownership first")
+	// ErrInviteNotFound is returned when an invite token doesn't exist
+	ErrInviteNotFound = errors.Error("invite not found")
+	// ErrInviteExpired is returned when an invite token is expired
+	ErrInviteExpired = errors.Error("invite expired")
+)
+
+const (
+	orgsBkt    = "orgs"
+	invitesBkt = "invites"
+)
+
+// DefaultInviteTTL is the ttl of invites when Orgs.Invite is called with a zero ttl
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+// New will return a new instance of Orgs.
+// Members are users of a, and their roles are reflected in p as the groups returned by Group and RoleGroup,
+// so resources can be granted to an organization's members with p.SetPermissions.
+func New(dir string, a *auth.Auth, p *permissions.Permissions) (op *Orgs, err error) {
+	o := Orgs{a: a, p: p}
+	if err = o.initDB(dir); err != nil {
+		return
+	}
+
+	op = &o
+	return
+}
+
+// Orgs manages organizations and their members
+type Orgs struct {
+	db *turtleDB.Turtle
+	a  *auth.Auth
+	p  *permissions.Permissions
+}
+
+func (o *Orgs) initDB(dir string) (err error) {
+	fm := turtleDB.NewFuncsMap(marshalOrg, unmarshalOrg)
+	fm.Put(invitesBkt, marshalInvite, unmarshalInvite)
+
+	if o.db, err = turtleDB.New("orgs", dir, fm); err != nil {
+		return
+	}
+
+	return o.db.Update(func(txn turtleDB.Txn) (err error) {
+		if _, err = txn.Create(orgsBkt); err != nil {
+			return
+		}
+
+		_, err = txn.Create(invitesBkt)
+		return
+	})
+}
+
+func (o *Orgs) getOrg(txn turtleDB.Txn, id string) (org Org, err error) {
+	var (
+		bkt turtleDB.Bucket
+		val turtleDB.Value
+		ok  bool
+	)
+
+	if bkt, err = txn.Get(orgsBkt); err != nil {
+		return
+	}
+
+	if val, err = bkt.Get(id); err != nil {
+		if err == turtleDB.ErrKeyDoesNotExist {
+			err = ErrOrgNotFound
+		}
+		return
+	}
+
+	if org, ok = val.(Org); !ok {
+		err = turtleDB.ErrInvalidType
+		return
+	}
+
+	org = org.Dup()
+	return
+}
+
+func (o *Orgs) putOrg(txn turtleDB.Txn, org Org) (err error) {
+	var bkt turtleDB.Bucket
+	if bkt, err = txn.Get(orgsBkt); err != nil {
+		return
+	}
+
+	return bkt.Put(org.ID, org)
+}
+
+func (o *Orgs) getInvite(txn turtleDB.Txn, id string) (inv Invite, err error) {
+	var (
+		bkt turtleDB.Bucket
+		val turtleDB.Value
+		ok  bool
+	)
+
+	if bkt, err = txn.Get(invitesBkt); err != nil {
+		return
+	}
+
+	if val, err = bkt.Get(id); err != nil {
+		if err == turtleDB.ErrKeyDoesNotExist {
+			err = ErrInviteNotFound
+		}
+		return
+	}
+
+	if inv, ok = val.(Invite); !ok {
+		err = turtleDB.ErrInvalidType
+	}
+
+	return
+}
+
+// update edits an organization, the groups of the members whose role changed are updated after the commit
+func (o *Orgs) update(id string, fn func(org *Org) error) (err error) {
+	var before, after Org
+	if err = o.db.Update(func(txn turtleDB.Txn) (err error) {
+		if before, err = o.getOrg(txn, id); err != nil {
+			return
+		}
+
+		after = before.Dup()
+		if err = fn(&after); err != nil {
+			return
+		}
+
+		return o.putOrg(txn, after)
+	}); err != nil {
+		return
+	}
+
+	return o.syncMembers(id, before.Members, after.Members)
+}
+
+// Create will create an organization owned by ownerID and return its ID
+func (o *Orgs) Create(name, ownerID string) (id string, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return "", ErrInvalidName
+	}
+
+	if _, err = o.a.GetUserByID(ownerID); err != nil {
+		return
+	}
+
+	org := Org{
+		ID:        auth.RandomToken(8, false),
+		Name:      name,
+		Members:   map[string]Role{ownerID: RoleOwner},
+		CreatedTS: time.Now().Unix(),
+	}
+
+	if err = o.db.Update(func(txn turtleDB.Txn) error {
+		return o.putOrg(txn, org)
+	}); err != nil {
+		return
+	}
+
+	id = org.ID
+	err = o.setGroups(id, ownerID, RoleOwner)
+	return
+}
+
+// Get will return an organization by its ID
+func (o *Orgs) Get(id string) (org Org, err error) {
+	err = o.db.Read(func(txn turtleDB.Txn) (err error) {
+		org, err = o.getOrg(txn, id)
+		return
+	})
+
+	return
+}
+
+// ForUser will return the organizations a user is a member of
+func (o *Orgs) ForUser(userID string) (orgs []Org, err error) {
+	err = o.ForEach(func(org Org) error {
+		if org.Role(userID) != RoleNone {
+			orgs = append(orgs, org)
+		}
+		return nil
+	})
+
+	return
+}
+
+// ForEach will iterate through all the organizations
+func (o *Orgs) ForEach(fn func(org Org) error) (err error) {
+	return o.db.Read(func(txn turtleDB.Txn) (err error) {
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(orgsBkt); err != nil {
+			return
+		}
+
+		return bkt.ForEach(func(_ string, val turtleDB.Value) error {
+			org, ok := val.(Org)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+			return fn(org.Dup())
+		})
+	})
+}
+
+// SetRole will change the role of a member, admins can manage members and only the owner can manage admins.
+// The owner's role can't be changed and RoleOwner can't be granted, see TransferOwnership.
+func (o *Orgs) SetRole(orgID, actorID, userID string, role Role) (err error) {
+	if !role.isValid() || role == RoleOwner {
+		return ErrInvalidRole
+	}
+
+	return o.update(orgID, func(org *Org) (err error) {
+		cur := org.Role(userID)
+		switch {
+		case cur == RoleNone:
+			return ErrNotMember
+		case cur == RoleOwner:
+			return ErrOwner
+		case !canManage(org.Role(actorID), cur, role):
+			return ErrForbidden
+		}
+
+		org.Members[userID] = role
+		return
+	})
+}
+
+// Remove will remove a member from an organization, members can always leave.
+// The owner can't be removed, see TransferOwnership.
+func (o *Orgs) Remove(orgID, actorID, userID string) (err error) {
+	return o.update(orgID, func(org *Org) (err error) {
+		cur := org.Role(userID)
+		switch {
+		case cur == RoleNone:
+			return ErrNotMember
+		case cur == RoleOwner:
+			return ErrOwner
+		case actorID != userID && !canManage(org.Role(actorID), cur, RoleNone):
+			return ErrForbidden
+		}
+
+		delete(org.Members, userID)
+		return
+	})
+}
+
+// TransferOwnership will make newOwnerID, who must be a member, the owner of the organization.
+// The previous owner becomes an admin.
+func (o *Orgs) TransferOwnership(orgID, ownerID, newOwnerID string) (err error) {
+	return o.update(orgID, func(org *Org) (err error) {
+		switch {
+		case org.Role(ownerID) != RoleOwner:
+			return ErrForbidden
+		case org.Role(newOwnerID) == RoleNone:
+			return ErrNotMember
+		case ownerID == newOwnerID:
+			return
+		}
+
+		org.Members[ownerID] = RoleAdmin
+		org.Members[newOwnerID] = RoleOwner
+		return
+	})
+}
+
+// Delete will delete an organization and its invites, only the owner can delete it
+func (o *Orgs) Delete(orgID, ownerID string) (err error) {
+	var org Org
+	if err = o.db.Update(func(txn turtleDB.Txn) (err error) {
+		if org, err = o.getOrg(txn, orgID); err != nil {
+			return
+		}
+
+		if org.Role(ownerID) != RoleOwner {
+			return ErrForbidden
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(orgsBkt); err != nil {
+			return
+		}
+
+		if err = bkt.Delete(orgID); err != nil {
+			return
+		}
+
+		return o.deleteInvites(txn, func(inv Invite) bool { return inv.OrgID == orgID })
+	}); err != nil {
+		return
+	}
+
+	return o.syncMembers(orgID, org.Members, nil)
+}
+
+// Sync will reset the organization groups of every member in the permissions store,
+// it is only needed if the groups were edited outside of Orgs
+func (o *Orgs) Sync() (err error) {
+	return o.ForEach(func(org Org) error {
+		for uid, role := range org.Members {
+			if err := o.setGroups(org.ID, uid, role); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close will close orgs, the Auth and Permissions instances aren't closed
+func (o *Orgs) Close() (err error) {
+	return o.db.Close()
+}
+
+// canManage will return if actor can change a member's role from cur to role, RoleNone being a removal
+func canManage(actor, cur, role Role) bool {
+	switch actor {
+	case RoleOwner:
+		return true
+	case RoleAdmin:
+		return cur == RoleMember && role != RoleAdmin
+	}
+
+	return false
+}
+
+// syncMembers will update the groups of the members whose role differs between before and after
+func (o *Orgs) syncMembers(orgID string, before, after map[string]Role) (err error) {
+	for uid, role := range before {
+		if after[uid] != role {
+			if err = o.setGroups(orgID, uid, after[uid]); err != nil {
+				return
+			}
+		}
+	}
+
+	for uid, role := range after {
+		if _, ok := before[uid]; !ok {
+			if err = o.setGroups(orgID, uid, role); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// setGroups will replace the groups of a user within an organization by the ones of their role
+func (o *Orgs) setGroups(orgID, userID string, role Role) (err error) {
+	var gs []string
+	if gs, err = o.p.Groups(userID); err != nil && err != turtleDB.ErrKeyDoesNotExist {
+		return
+	}
+
+	want := groupsFor(orgID, role)
+	var stale []string
+	for _, g := range gs {
+		if isOrgGroup(orgID, g) && !hasGroup(want, g) {
+			stale = append(stale, g)
+		}
+	}
+
+	if len(stale) > 0 {
+		if err = o.p.RemoveGroup(userID, stale...); err != nil && err != permissions.ErrPermissionsUnchanged {
+			return
+		}
+	}
+
+	if len(want) > 0 {
+		if err = o.p.AddGroup(userID, want...); err != nil && err != permissions.ErrPermissionsUnchanged {
+			return
+		}
+	}
+
+	return nil
+}
+
+func hasGroup(gs []string, group string) bool {
+	for _, g := range gs {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,183 @@
+package orgs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PathDNA/auth"
+	"github.com/PathDNA/auth/permissions"
+)
+
+func TestOrgs(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "orgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := auth.New(filepath.Join(tmpPath, "auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	p, err := permissions.New(filepath.Join(tmpPath, "permissions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	o, err := New(filepath.Join(tmpPath, "orgs"), a, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	owner, _ := a.CreateUser("owner", "password")
+	admin, _ := a.CreateUser("admin", "password")
+	member, _ := a.CreateUser("member", "password")
+
+	if _, err = o.Create("acme", "nobody"); err == nil {
+		t.Fatal("created an org owned by an unknown user")
+	}
+
+	id, err := o.Create("acme", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.SetPermissions("acme.billing", RoleGroup(id, RoleAdmin), permissions.ActionRead|permissions.ActionWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Can(owner, "acme.billing", permissions.ActionWrite) {
+		t.Fatal("the owner should be in the admin group")
+	}
+
+	if _, err = o.Invite(id, owner, "x@example.com", RoleOwner, 0); err != ErrInvalidRole {
+		t.Fatalf("expected ErrInvalidRole, got %v", err)
+	}
+
+	inv, err := o.Invite(id, owner, "admin@example.com", RoleAdmin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Accept("bad token", admin); err != ErrInviteNotFound {
+		t.Fatalf("expected ErrInviteNotFound, got %v", err)
+	}
+
+	if _, err = o.Accept(inv.Token, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Accept(inv.Token, admin); err != ErrInviteNotFound {
+		t.Fatalf("expected ErrInviteNotFound, got %v", err)
+	}
+
+	if !p.Can(admin, "acme.billing", permissions.ActionRead) {
+		t.Fatal("the admin should be able to read the billing")
+	}
+
+	if _, err = o.Invite(id, admin, "admin2@example.com", RoleAdmin, 0); err != ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+
+	if inv, err = o.Invite(id, admin, "member@example.com", RoleMember, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+	if _, err = o.Accept(inv.Token, member); err != ErrInviteExpired {
+		t.Fatalf("expected ErrInviteExpired, got %v", err)
+	}
+
+	if err = o.PurgeInvites(); err != nil {
+		t.Fatal(err)
+	}
+
+	if invs, _ := o.Invites(id); len(invs) != 0 {
+		t.Fatalf("unexpected invites: %+v", invs)
+	}
+
+	if inv, err = o.Invite(id, admin, "member@example.com", RoleMember, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Accept(inv.Token, member); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Has(member, Group(id)) || p.Can(member, "acme.billing", permissions.ActionRead) {
+		t.Fatal("unexpected member groups")
+	}
+
+	if err = o.SetRole(id, admin, member, RoleAdmin); err != ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+
+	if err = o.SetRole(id, owner, member, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Can(member, "acme.billing", permissions.ActionRead) {
+		t.Fatal("the promoted member should be able to read the billing")
+	}
+
+	if err = o.Remove(id, admin, owner); err != ErrOwner {
+		t.Fatalf("expected ErrOwner, got %v", err)
+	}
+
+	if err = o.TransferOwnership(id, admin, member); err != ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+
+	if err = o.TransferOwnership(id, owner, member); err != nil {
+		t.Fatal(err)
+	}
+
+	org, err := o.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if org.Owner() != member || org.Role(owner) != RoleAdmin {
+		t.Fatalf("unexpected members: %+v", org.Members)
+	}
+
+	if p.Has(owner, RoleGroup(id, RoleOwner)) || !p.Has(member, RoleGroup(id, RoleOwner)) {
+		t.Fatal("the owner groups weren't moved")
+	}
+
+	// members can always leave
+	if err = o.Remove(id, admin, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Has(admin, Group(id)) || p.Can(admin, "acme.billing", permissions.ActionRead) {
+		t.Fatal("the removed admin still has the org groups")
+	}
+
+	if orgs, _ := o.ForUser(admin); len(orgs) != 0 {
+		t.Fatalf("unexpected orgs: %+v", orgs)
+	}
+
+	if err = o.Delete(id, owner); err != ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+
+	if err = o.Delete(id, member); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Get(id); err != ErrOrgNotFound {
+		t.Fatalf("expected ErrOrgNotFound, got %v", err)
+	}
+
+	if p.Has(member, Group(id)) || p.Has(owner, Group(id)) {
+		t.Fatal("the deleted org's groups weren't removed")
+	}
+}
@@ -0,0 +1,564 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	outboxBkt     = "outbox"
+	outboxDeadBkt = "outbox.dead"
+
+	// SignatureHeader is the header WebhookSink puts the hex HMAC-SHA256 of the body in.
+	SignatureHeader = "X-Auth-Signature"
+	// EventIDHeader is the header WebhookSink puts the event ID in, receivers should use it to drop duplicates.
+	EventIDHeader = "X-Auth-Event-Id"
+)
+
+// Default OutboxOptions values.
+const (
+	DefaultOutboxMaxAttempts = 10
+	DefaultOutboxMinBackoff  = time.Second
+	DefaultOutboxMaxBackoff  = 5 * time.Minute
+	DefaultOutboxInterval    = time.Second
+)
+
+// OutboxEvent is a user change waiting to be delivered to the outbox's Sink.
+// Old and New don't include the password, the password history or the encrypted profile fields.
+// The writes that don't go through the user changes have no events, see Options.Outbox.
+type OutboxEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// TS is the time of the change in unix nanoseconds.
+	TS int64 `json:"ts"`
+
+	Actor  string `json:"actor,omitempty"`
+	UserID string `json:"userID"`
+
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+
+	Attempts  int    `json:"attempts,omitempty"`
+	NextTS    int64  `json:"nextTS,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Sink delivers outbox events, an event is removed from the outbox once Send returns nil.
+// Events are delivered at-least-once, so Send may be called more than once with the same event.
+type Sink interface {
+	Send(ev *OutboxEvent) error
+}
+
+// ContextSink is a Sink that can be interrupted, the dispatcher calls SendContext instead of Send
+// and cancels ctx when the Auth is closed. The interrupted event stays pending.
+type ContextSink interface {
+	Sink
+	SendContext(ctx context.Context, ev *OutboxEvent) error
+}
+
+// OutboxOptions enables the transactional outbox, see Options.Outbox.
+type OutboxOptions struct {
+	Sink Sink
+
+	// MaxAttempts is the number of failed deliveries after which an event is moved to the dead letters.
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the delay between attempts, it doubles on every failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Interval is how often the outbox is checked for due events, the dispatcher is also woken up on every change.
+	Interval time.Duration
+
+	// OnError is called with the errors of the background dispatcher, such as failing to read or update the outbox.
+	// The errors of Sink are recorded in the events' LastError instead.
+	OnError func(err error)
+}
+
+func (o *OutboxOptions) backoff(attempts int) time.Duration {
+	d := o.MinBackoff
+	for i := 1; i < attempts && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	return d
+}
+
+// outbox is the dispatcher of the outbox bucket.
+type outbox struct {
+	a    *Auth
+	opts OutboxOptions
+
+	// mux serializes dispatch passes.
+	mux sync.Mutex
+
+	wake chan struct{}
+
+	// ctx is cancelled by stop, it interrupts the ContextSinks.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newOutbox(a *Auth, opts OutboxOptions) *outbox {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultOutboxMinBackoff
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultOutboxMaxBackoff
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOutboxInterval
+	}
+
+	ob := &outbox{
+		a:    a,
+		opts: opts,
+		wake: make(chan struct{}, 1),
+	}
+
+	ob.ctx, ob.cancel = context.WithCancel(context.Background())
+	return ob
+}
+
+func (ob *outbox) start() {
+	ob.wg.Add(1)
+	go ob.run()
+}
+
+func (ob *outbox) run() {
+	defer ob.wg.Done()
+
+	t := time.NewTicker(ob.opts.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ob.ctx.Done():
+			return
+		case <-ob.wake:
+		case <-t.C:
+		}
+
+		if err := ob.dispatch(); err != nil && ob.opts.OnError != nil {
+			ob.opts.OnError(err)
+		}
+	}
+}
+
+func (ob *outbox) send(ev *OutboxEvent) error {
+	if cs, ok := ob.opts.Sink.(ContextSink); ok {
+		return cs.SendContext(ob.ctx, ev)
+	}
+	return ob.opts.Sink.Send(ev)
+}
+
+// notify wakes up the dispatcher, it is safe to call on a nil outbox.
+func (ob *outbox) notify() {
+	if ob == nil {
+		return
+	}
+
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (ob *outbox) stop() {
+	ob.cancel()
+	ob.wg.Wait()
+}
+
+// dispatch delivers the due events in order, it stops at the first event that can't be delivered yet
+// so a receiver never sees the changes of a user out of order.
+func (ob *outbox) dispatch() error {
+	ob.mux.Lock()
+	defer ob.mux.Unlock()
+
+	evs, err := ob.a.outboxEvents(outboxBkt)
+	if err != nil {
+		return err
+	}
+
+	for i := range evs {
+		ev := &evs[i]
+		if ev.NextTS > time.Now().UnixNano() {
+			return nil
+		}
+
+		serr := ob.send(ev)
+		if cerr := ob.ctx.Err(); serr != nil && cerr != nil && errors.Is(serr, cerr) {
+			// interrupted by Close, it isn't a failed attempt
+			return nil
+		}
+
+		var dead bool
+		if err = ob.a.update(func(tx turtleDB.Txn) (err error) {
+			dead, err = ob.settle(tx, ev, serr)
+			return
+		}); err != nil {
+			return err
+		}
+
+		if serr != nil && !dead {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// settle removes ev from the outbox if it was delivered, otherwise it schedules the next attempt
+// or moves it to the dead letters.
+func (ob *outbox) settle(tx turtleDB.Txn, ev *OutboxEvent, serr error) (dead bool, err error) {
+	var bkt, deadB turtleDB.Bucket
+	if bkt, err = tx.Get(outboxBkt); err != nil {
+		return
+	}
+
+	if serr == nil {
+		err = bkt.Delete(ev.ID)
+		return
+	}
+
+	ev.Attempts++
+	ev.LastError = serr.Error()
+	ev.NextTS = time.Now().Add(ob.opts.backoff(ev.Attempts)).UnixNano()
+
+	if ev.Attempts < ob.opts.MaxAttempts {
+		err = bkt.Put(ev.ID, *ev)
+		return
+	}
+
+	if deadB, err = tx.Get(outboxDeadBkt); err != nil {
+		return
+	}
+
+	ev.NextTS = 0
+	if err = deadB.Put(ev.ID, *ev); err != nil {
+		return
+	}
+
+	return true, bkt.Delete(ev.ID)
+}
+
+// appendOutbox adds the events to the outbox as part of tx, it is a no-op if the outbox is disabled.
+func (a *Auth) appendOutbox(tx turtleDB.Txn, evs []HookEvent) error {
+	if a.outbox == nil {
+		return nil
+	}
+
+	bkt, err := tx.Get(outboxBkt)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	for i := range evs {
+		hev := &evs[i]
+		ev := OutboxEvent{Type: hev.Type.String(), TS: now, Actor: hev.Actor}
+
+		if hev.New != nil {
+			ev.UserID = hev.New.ID
+		} else {
+			ev.UserID = hev.Old.ID
+		}
+
+		if ev.Old, err = outboxUser(hev.Old); err != nil {
+			return err
+		}
+
+		if ev.New, err = outboxUser(hev.New); err != nil {
+			return err
+		}
+
+		if ev.ID, err = a.nextID(tx, outboxBkt); err != nil {
+			return err
+		}
+
+		if err = bkt.Put(ev.ID, ev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// outboxUser returns the json of u without the password and the encrypted profile fields.
+func outboxUser(u *User) (json.RawMessage, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	cp := *u
+	cp.Password, cp.PasswordHistory = "", nil
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return nil, err
+	}
+
+	specs, err := profileFieldSpecs(cp.Profile)
+	if err != nil || len(specs) == 0 {
+		return b, err
+	}
+
+	return mapProfileFields(b, specs, func(string, string) (string, error) { return "", nil })
+}
+
+// DispatchOutbox delivers the due outbox events now instead of waiting for the dispatcher.
+func (a *Auth) DispatchOutbox() error {
+	if a.outbox == nil {
+		return ErrOutboxDisabled
+	}
+
+	return a.outbox.dispatch()
+}
+
+// PendingOutbox returns the events waiting to be delivered, oldest first.
+func (a *Auth) PendingOutbox() ([]OutboxEvent, error) {
+	return a.outboxEvents(outboxBkt)
+}
+
+// DeadLetters returns the events that failed to be delivered OutboxOptions.MaxAttempts times, oldest first.
+func (a *Auth) DeadLetters() ([]OutboxEvent, error) {
+	return a.outboxEvents(outboxDeadBkt)
+}
+
+// RetryDeadLetters moves the dead letters back to the outbox with their attempts reset.
+func (a *Auth) RetryDeadLetters() (n int, err error) {
+	if a.outbox == nil {
+		return 0, ErrOutboxDisabled
+	}
+
+	if err = a.update(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(outboxBkt)
+		if err != nil {
+			return err
+		}
+
+		deadB, err := tx.Get(outboxDeadBkt)
+		if err != nil {
+			return err
+		}
+
+		var evs []OutboxEvent
+		if err = forEachOutboxEvent(deadB, func(ev *OutboxEvent) error {
+			evs = append(evs, *ev)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, ev := range evs {
+			ev.Attempts, ev.NextTS, ev.LastError = 0, 0, ""
+			if err = bkt.Put(ev.ID, ev); err != nil {
+				return err
+			}
+
+			if err = deadB.Delete(ev.ID); err != nil {
+				return err
+			}
+		}
+
+		n = len(evs)
+		return nil
+	}); err == nil && n > 0 {
+		a.outbox.notify()
+	}
+
+	return
+}
+
+func (a *Auth) outboxEvents(name string) (evs []OutboxEvent, err error) {
+	if err = a.read(func(tx turtleDB.Txn) error {
+		bkt, err := tx.Get(name)
+		if err != nil {
+			return err
+		}
+
+		return forEachOutboxEvent(bkt, func(ev *OutboxEvent) error {
+			evs = append(evs, *ev)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(evs, func(i, j int) bool { return lessID(evs[i].ID, evs[j].ID) })
+	return
+}
+
+func forEachOutboxEvent(bkt turtleDB.Bucket, fn func(ev *OutboxEvent) error) error {
+	return bkt.ForEach(func(_ string, val turtleDB.Value) error {
+		ev, ok := val.(OutboxEvent)
+		if !ok {
+			return unexpectedTypeError(val)
+		}
+		return fn(&ev)
+	})
+}
+
+// lessID compares the decimal IDs returned by nextID.
+func lessID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func marshalOutboxEvent(v turtleDB.Value) ([]byte, error) {
+	ev, ok := v.(OutboxEvent)
+	if !ok {
+		return nil, unexpectedTypeError(v)
+	}
+	return json.Marshal(ev)
+}
+
+func unmarshalOutboxEvent(b []byte) (turtleDB.Value, error) {
+	var ev OutboxEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// WebhookSink posts the events as json to URL, signed with Secret in the SignatureHeader.
+// Any response other than 2xx is a failed delivery.
+type WebhookSink struct {
+	URL    string
+	Secret []byte
+
+	// Client defaults to a client with a 10 seconds timeout.
+	Client *http.Client
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Send implements Sink.
+func (s *WebhookSink) Send(ev *OutboxEvent) error {
+	return s.SendContext(context.Background(), ev)
+}
+
+// SendContext implements ContextSink.
+func (s *WebhookSink) SendContext(ctx context.Context, ev *OutboxEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, ev.ID)
+	req.Header.Set(SignatureHeader, "sha256="+SignPayload(s.Secret, body))
+
+	c := s.Client
+	if c == nil {
+		c = defaultWebhookClient
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SignPayload returns the hex HMAC-SHA256 of body, receivers of WebhookSink can use it to check the signature.
+func SignPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ChanSink sends the events to a channel, it blocks the dispatcher until the event is received
+// or the Auth is closed.
+type ChanSink chan OutboxEvent
+
+// Send implements Sink.
+func (c ChanSink) Send(ev *OutboxEvent) error {
+	return c.SendContext(context.Background(), ev)
+}
+
+// SendContext implements ContextSink.
+func (c ChanSink) SendContext(ctx context.Context, ev *OutboxEvent) error {
+	select {
+	case c <- *ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileSink appends the events as json lines to a file.
+type FileSink struct {
+	mux sync.Mutex
+	f   *os.File
+}
+
+// NewFileSink returns a FileSink appending to the file at path.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{f: f}, nil
+}
+
+// Send implements Sink, the event is synced to disk before it returns.
+func (s *FileSink) Send(ev *OutboxEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, err = s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return s.f.Sync()
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.f.Close()
+}
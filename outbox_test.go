@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+func TestOutbox(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		secret = []byte("ecto")
+
+		mux  sync.Mutex
+		fail = true
+		got  []OutboxEvent
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mux.Lock()
+		defer mux.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get(SignatureHeader) != "sha256="+SignPayload(secret, body) {
+			t.Errorf("bad signature: %s", r.Header.Get(SignatureHeader))
+		}
+
+		var ev OutboxEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+		}
+
+		if ev.ID != r.Header.Get(EventIDHeader) {
+			t.Errorf("bad event id: %s", r.Header.Get(EventIDHeader))
+		}
+
+		got = append(got, ev)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(tmpPath, "db")
+	opts := Options{
+		Outbox: &OutboxOptions{
+			Sink:        &WebhookSink{URL: srv.URL, Secret: secret},
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+			Interval:    time.Hour,
+		},
+	}
+
+	a, err := NewWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("dana", "zuul")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.Status = StatusActive
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail an attempt before Close, which interrupts the attempts in flight.
+	if err = a.DispatchOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dispatcher can't deliver, so the events must survive a restart.
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewWithOptions(path, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	evs, err := a.PendingOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evs) != 3 || evs[0].Type != "create" || evs[1].Type != "edit" || evs[2].Type != "status" {
+		t.Fatalf("unexpected events: %+v", evs)
+	}
+
+	if strings.Contains(string(evs[0].New), "password") {
+		t.Fatalf("the password was included: %s", evs[0].New)
+	}
+
+	mux.Lock()
+	fail = false
+	mux.Unlock()
+
+	// wait for the backoff of the failed attempt
+	time.Sleep(10 * time.Millisecond)
+
+	if err = a.DispatchOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	if evs, _ = a.PendingOutbox(); len(evs) != 0 {
+		t.Fatalf("expected an empty outbox, got %+v", evs)
+	}
+
+	mux.Lock()
+	if len(got) != 3 || got[0].UserID != id || got[0].Attempts == 0 {
+		t.Fatalf("unexpected deliveries: %+v", got)
+	}
+	mux.Unlock()
+}
+
+type failSink struct{}
+
+func (failSink) Send(*OutboxEvent) error { return errors.Error("down") }
+
+func TestOutboxDeadLetters(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewWithOptions(filepath.Join(tmpPath, "db"), Options{
+		Outbox: &OutboxOptions{
+			Sink:        failSink{},
+			MaxAttempts: 2,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+			Interval:    time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	id, err := a.CreateUser("louis", "keymaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.DeleteUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	var dead []OutboxEvent
+	for start := time.Now(); len(dead) < 2; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for dead letters: %+v", dead)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		if dead, err = a.DeadLetters(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dead[0].Type != "create" || dead[1].Type != "delete" || dead[1].Old == nil || dead[0].LastError != "down" {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+
+	n, err := a.RetryDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Fatalf("expected 2 events, got %d", n)
+	}
+}
+
+func TestChanSinkClose(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		c    = make(ChanSink)
+		opts = Options{Outbox: &OutboxOptions{Sink: c, Interval: time.Millisecond}}
+	)
+
+	a, err := NewWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.CreateUser("winston", "i love this town"); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody receives the event, Close must not wait for it
+	closed := make(chan error, 1)
+	go func() { closed <- a.Close() }()
+
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is blocked by the sink")
+	}
+
+	if a, err = NewWithOptions(path, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	select {
+	case ev := <-c:
+		if ev.Type != "create" || ev.Attempts != 0 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the pending event")
+	}
+}
+
+func TestWebhookSinkClose(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	var (
+		release = make(chan struct{})
+		called  = make(chan struct{}, 1)
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	var (
+		path = filepath.Join(tmpPath, "db")
+		opts = Options{Outbox: &OutboxOptions{Sink: &WebhookSink{URL: srv.URL}, Interval: time.Millisecond}}
+	)
+
+	a, err := NewWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.CreateUser("winston", "i love this town"); err != nil {
+		t.Fatal(err)
+	}
+
+	<-called
+
+	// the request hangs, Close must interrupt it instead of waiting for the client timeout
+	closed := make(chan error, 1)
+	go func() { closed <- a.Close() }()
+
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is blocked by the sink")
+	}
+
+	if a, err = NewWithOptions(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	evs, err := a.PendingOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evs) != 1 || evs[0].Attempts != 0 {
+		t.Fatalf("the interrupted event wasn't left pending: %+v", evs)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	fp := filepath.Join(tmpPath, "events.jsonl")
+	s, err := NewFileSink(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if err = s.Send(&OutboxEvent{ID: id, Type: "create"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+}
@@ -10,6 +10,8 @@ const (
 	ErrInvalidActions = errors.Error("invalid permissions, please see constant block for reference")
 	// ErrPermissionsUnchanged is returned when matching permissions are set for a resource
 	ErrPermissionsUnchanged = errors.Error("permissions match, unchanged")
+	// ErrExists is returned when an entry is put without overwrite and it already exists
+	ErrExists = errors.Error("entry already exists")
 )
 
 // Action represents an action type
@@ -313,6 +315,104 @@ func (p *Permissions) Groups(uuid string) (gs []string, err error) {
 	return
 }
 
+// ForEachResource will iterate through all the resources and the actions of their groups
+func (p *Permissions) ForEachResource(fn func(id string, actions map[string]Action) error) (err error) {
+	return p.db.Read(func(txn turtleDB.Txn) (err error) {
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(resourceBkt); err != nil {
+			return
+		}
+
+		return bkt.ForEach(func(id string, val turtleDB.Value) (err error) {
+			r, ok := val.(resource)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+
+			return fn(id, r.Dup())
+		})
+	})
+}
+
+// ForEachGroups will iterate through all the uuids and the groups they belong to
+func (p *Permissions) ForEachGroups(fn func(uuid string, groups []string) error) (err error) {
+	return p.db.Read(func(txn turtleDB.Txn) (err error) {
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(groupsBkt); err != nil {
+			return
+		}
+
+		return bkt.ForEach(func(uuid string, val turtleDB.Value) (err error) {
+			g, ok := val.(groups)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+
+			return fn(uuid, g.Slice())
+		})
+	})
+}
+
+// HasResource will return whether or not a resource id has permissions
+func (p *Permissions) HasResource(id string) (ok bool) {
+	p.db.Read(func(txn turtleDB.Txn) (err error) {
+		_, err = p.getResource(txn, id)
+		ok = err == nil
+		return
+	})
+
+	return
+}
+
+// HasGroups will return whether or not a uuid has groups
+func (p *Permissions) HasGroups(uuid string) (ok bool) {
+	p.db.Read(func(txn turtleDB.Txn) (err error) {
+		_, err = p.getGroups(txn, uuid)
+		ok = err == nil
+		return
+	})
+
+	return
+}
+
+// PutResource will replace the actions of all the groups for a resource id,
+// if overwrite is false and the resource exists, ErrExists is returned
+func (p *Permissions) PutResource(id string, actions map[string]Action, overwrite bool) (err error) {
+	r := make(resource, len(actions))
+	for group, acts := range actions {
+		if !isValidActions(acts) {
+			return ErrInvalidActions
+		}
+
+		r[group] = acts
+	}
+
+	return p.db.Update(func(txn turtleDB.Txn) (err error) {
+		if _, err = p.getResource(txn, id); err == nil && !overwrite {
+			return ErrExists
+		}
+
+		return p.putResource(txn, id, r)
+	})
+}
+
+// PutGroups will replace the groups of a uuid,
+// if overwrite is false and the uuid has groups, ErrExists is returned
+func (p *Permissions) PutGroups(uuid string, grouplist []string, overwrite bool) (err error) {
+	g := make(groups, len(grouplist))
+	for _, group := range grouplist {
+		g.Set(group)
+	}
+
+	return p.db.Update(func(txn turtleDB.Txn) (err error) {
+		if _, err = p.getGroups(txn, uuid); err == nil && !overwrite {
+			return ErrExists
+		}
+
+		return p.putGroups(txn, uuid, g)
+	})
+}
+
 // Close will close permissions
 func (p *Permissions) Close() (err error) {
 	return p.db.Close()
@@ -72,6 +72,14 @@ func TestPermissions(t *testing.T) {
 	if !p.Can(testUser3, "posts", ActionDelete) {
 		t.Fatal(testErrCannot)
 	}
+
+	if !p.HasResource("posts") || p.HasResource("comments") {
+		t.Fatal("unexpected resources")
+	}
+
+	if !p.HasGroups(testUser1) || p.HasGroups("TEST_USER_4") {
+		t.Fatal("unexpected groups")
+	}
 }
 
 func testPerms(p *Permissions, t *testing.T) {
@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// expiry is a min-heap of store keys by the time their sessions may expire, purging pops the due keys instead of
+// scanning every session. The deadlines are lower bounds as activity pushes them back, the popped sessions which
+// are still alive are pushed again with their new deadline
+type expiry struct {
+	mux sync.Mutex
+
+	h     expiryHeap
+	items map[string]*expiryItem
+}
+
+type expiryItem struct {
+	key string
+	at  int64
+	idx int
+}
+
+// push will add a key or update its deadline
+func (e *expiry) push(key string, at int64) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.items == nil {
+		e.items = make(map[string]*expiryItem)
+	}
+
+	if it, ok := e.items[key]; ok {
+		it.at = at
+		heap.Fix(&e.h, it.idx)
+		return
+	}
+
+	it := &expiryItem{key: key, at: at}
+	e.items[key] = it
+	heap.Push(&e.h, it)
+}
+
+// due will pop the keys with a deadline before or at now
+func (e *expiry) due(now int64) (keys []string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	for len(e.h) > 0 && e.h[0].at <= now {
+		it := heap.Pop(&e.h).(*expiryItem)
+		delete(e.items, it.key)
+		keys = append(keys, it.key)
+	}
+
+	return
+}
+
+// len will return the number of keys
+func (e *expiry) len() int {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return len(e.h)
+}
+
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	it := x.(*expiryItem)
+	it.idx = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,81 @@
+package sessions
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	var e expiry
+	e.push("a", 30)
+	e.push("b", 10)
+	e.push("c", 20)
+	e.push("a", 5)
+
+	if keys := e.due(15); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("unexpected due keys: %v", keys)
+	}
+
+	if keys := e.due(15); len(keys) != 0 {
+		t.Fatalf("unexpected due keys: %v", keys)
+	}
+
+	if n := e.len(); n != 1 {
+		t.Fatalf("expected 1 key, got %d", n)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := mustNew(t, "", Options{IdleTimeout: time.Hour})
+	defer s.Close()
+
+	t1, k1 := s.New(testUser1)
+	t2, k2, _ := s.NewWithOptions(testUser2, SessionOptions{MaxLifetime: time.Second})
+
+	// the first session was active since it was scheduled
+	s.exp.push(s.storeKey(t1), time.Now().Unix())
+
+	time.Sleep(time.Second)
+	if err := s.expire(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(t1, k1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.store.Get(s.storeKey(t2)); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected the session to be purged, got %v", err)
+	}
+
+	if _, err := s.Get(t2, k2); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if n := s.exp.len(); n != 1 {
+		t.Fatalf("expected 1 scheduled session, got %d", n)
+	}
+}
+
+// BenchmarkPurge compares scanning every session to popping the due ones, with nothing to purge
+func BenchmarkPurge(b *testing.B) {
+	s := mustNew(b, "", Options{Store: NewMemoryStore()})
+	defer s.Close()
+
+	for i := 0; i < 20000; i++ {
+		s.New("user-" + strconv.Itoa(i%1000))
+	}
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.Purge(0)
+		}
+	})
+
+	b.Run("incremental", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.expire()
+		}
+	})
+}
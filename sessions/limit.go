@@ -0,0 +1,113 @@
+package sessions
+
+import (
+	"sort"
+)
+
+// LimitPolicy is what happens to a new session of a uuid at the session limit, see Options.MaxSessions
+type LimitPolicy uint8
+
+const (
+	// LimitReject will refuse the new session with ErrTooManySessions
+	LimitReject LimitPolicy = iota
+	// LimitEvictOldest will remove the oldest session of the uuid
+	LimitEvictOldest
+	// LimitEvictIdle will remove the least recently active session of the uuid
+	LimitEvictIdle
+)
+
+// String will return the name of the policy
+func (p LimitPolicy) String() string {
+	switch p {
+	case LimitReject:
+		return "reject"
+	case LimitEvictOldest:
+		return "evict-oldest"
+	case LimitEvictIdle:
+		return "evict-idle"
+	default:
+		return "invalid"
+	}
+}
+
+// Count will return the number of sessions of a uuid which count towards Options.MaxSessions
+func (s *Sessions) Count(uuid string) (n int, err error) {
+	var rs []*Record
+	if _, rs, err = s.limited(uuid); err != nil {
+		return
+	}
+
+	return len(rs), nil
+}
+
+// limited will return the active sessions of a uuid which count towards the limit
+func (s *Sessions) limited(uuid string) (keys []string, rs []*Record, err error) {
+	var (
+		all  []string
+		arec []*Record
+	)
+
+	if all, arec, err = s.active(uuid); err != nil {
+		return
+	}
+
+	for i, r := range arec {
+		if r.Impersonator == "" {
+			keys = append(keys, all[i])
+			rs = append(rs, r)
+		}
+	}
+
+	return
+}
+
+// makeRoom will apply the limit policy before a new session of uuid is created, the caller must hold s.mux.
+// Sessions sharing a store only apply the limit to the sessions they create
+func (s *Sessions) makeRoom(uuid string) (err error) {
+	var (
+		keys []string
+		rs   []*Record
+	)
+
+	if keys, rs, err = s.limited(uuid); err != nil {
+		return
+	}
+
+	n := len(rs) - s.opts.MaxSessions + 1
+	if n <= 0 {
+		return
+	}
+
+	var less func(a, b *Record) bool
+	switch s.opts.LimitPolicy {
+	case LimitEvictOldest:
+		less = func(a, b *Record) bool { return a.CreatedAt < b.CreatedAt }
+	case LimitEvictIdle:
+		less = func(a, b *Record) bool { return a.LastAction < b.LastAction }
+	default:
+		return ErrTooManySessions
+	}
+
+	idx := make([]int, len(rs))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	sort.Slice(idx, func(i, j int) bool {
+		a, b := rs[idx[i]], rs[idx[j]]
+		if less(a, b) {
+			return true
+		} else if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+
+	for _, i := range idx[:n] {
+		if err = s.remove(keys[i], rs[i]); err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+	}
+
+	return nil
+}
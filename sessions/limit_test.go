@@ -0,0 +1,123 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+// age will set the creation and last action of the session of token
+func age(t *testing.T, s *Sessions, token string, created, last int64) {
+	r, err := s.store.Get(s.storeKey(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.CreatedAt, r.LastAction = created, last
+	if err = s.store.Put(s.storeKey(token), r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	now := time.Now().Unix()
+
+	t.Run("reject", func(t *testing.T) {
+		s := mustNew(t, "", Options{MaxSessions: 2})
+		defer s.Close()
+
+		t1, k1 := s.New(testUser1)
+		s.New(testUser1)
+		s.New(testUser2)
+
+		if _, _, err := s.NewWithOptions(testUser1, SessionOptions{}); err != ErrTooManySessions {
+			t.Fatalf("expected ErrTooManySessions, got %v", err)
+		}
+
+		// impersonation sessions don't count
+		if _, _, err := s.Impersonate(t1, k1, testUser1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := s.Count(testUser1); err != nil || n != 2 {
+			t.Fatalf("expected 2 sessions, got %d %v", n, err)
+		}
+
+		if err := s.Delete(t1, k1); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := s.NewWithOptions(testUser1, SessionOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("evict-oldest", func(t *testing.T) {
+		s := mustNew(t, "", Options{MaxSessions: 2, LimitPolicy: LimitEvictOldest})
+		defer s.Close()
+
+		t1, k1 := s.New(testUser1)
+		t2, k2 := s.New(testUser1)
+		age(t, s, t1, now-20, now)
+		age(t, s, t2, now-10, now-5)
+
+		t3, k3 := s.New(testUser1)
+
+		if _, err := s.Get(t1, k1); err != ErrSessionDoesNotExist {
+			t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+		}
+
+		for _, p := range [][2]string{{t2, k2}, {t3, k3}} {
+			if _, err := s.Get(p[0], p[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("evict-idle", func(t *testing.T) {
+		s := mustNew(t, "", Options{MaxSessions: 2, LimitPolicy: LimitEvictIdle})
+		defer s.Close()
+
+		t1, k1 := s.New(testUser1)
+		t2, k2 := s.New(testUser1)
+		age(t, s, t1, now-20, now)
+		age(t, s, t2, now-10, now-5)
+
+		// a rotated session still counts once
+		nt1, nk1, err := s.Rotate(t1, k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := s.Count(testUser1); err != nil || n != 2 {
+			t.Fatalf("expected 2 sessions, got %d %v", n, err)
+		}
+
+		s.New(testUser1)
+
+		if _, err = s.Get(t2, k2); err != ErrSessionDoesNotExist {
+			t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+		}
+
+		if _, err = s.Get(nt1, nk1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("evict-impersonator", func(t *testing.T) {
+		s := mustNew(t, "", Options{MaxSessions: 1, LimitPolicy: LimitEvictOldest})
+		defer s.Close()
+
+		t1, k1 := s.New(testUser1)
+		it, ik, err := s.Impersonate(t1, k1, testUser2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the evicted session takes its impersonation sessions with it
+		s.New(testUser1)
+
+		if _, err = s.Get(it, ik); err != ErrSessionDoesNotExist {
+			t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+		}
+	})
+}
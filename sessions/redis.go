@@ -0,0 +1,539 @@
+package sessions
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+// ErrRedisReply is returned when a redis server sends an unexpected reply
+const ErrRedisReply = errors.Error("unexpected redis reply")
+
+// DefaultRedisPrefix is the default prefix of the keys of a redis store
+const DefaultRedisPrefix = "sessions:"
+
+// RedisOptions are the settings of a redis store
+type RedisOptions struct {
+	// Prefix is prepended to all the keys, defaults to DefaultRedisPrefix
+	Prefix string
+	// Password is sent with AUTH if it isn't empty
+	Password string
+	// DB is selected with SELECT if it isn't zero
+	DB int
+	// Timeout is the dial, read and write timeout, zero means no timeout
+	Timeout time.Duration
+}
+
+// NewRedisStore will return a Store backed by the redis server at addr, sessions are shared by every Sessions
+// using the same server and prefix. The store uses a single connection which is redialed after network errors
+func NewRedisStore(addr string, opts RedisOptions) (rs *RedisStore, err error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultRedisPrefix
+	}
+
+	r := RedisStore{addr: addr, opts: opts}
+	r.sopts.IdleTimeout = time.Second * SessionTimeout
+	r.sopts.PurgeInterval = DefaultPurgeInterval
+	if err = r.dial(); err != nil {
+		return
+	}
+
+	rs = &r
+	return
+}
+
+// RedisStore is a Store backed by a redis server, each session is a JSON string and the keys of each uuid are a set.
+// The keys expire a full purge after the end of their sessions, see Options.PurgeInterval, so the sessions left
+// without any Sessions purging them are removed by the server
+type RedisStore struct {
+	mux sync.Mutex
+
+	addr string
+	opts RedisOptions
+	// sopts are the options of the Sessions using the store, for the expiry of the keys
+	sopts Options
+
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (r *RedisStore) dial() (err error) {
+	if r.conn, err = net.DialTimeout("tcp", r.addr, r.opts.Timeout); err != nil {
+		return
+	}
+
+	r.rd = bufio.NewReader(r.conn)
+
+	if r.opts.Password != "" {
+		if _, err = r.do("AUTH", r.opts.Password); err != nil {
+			r.reset()
+			return
+		}
+	}
+
+	if r.opts.DB != 0 {
+		if _, err = r.do("SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			r.reset()
+			return
+		}
+	}
+
+	return
+}
+
+func (r *RedisStore) reset() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn, r.rd = nil, nil
+	}
+}
+
+// cmd will run a command, the connection is redialed if needed and dropped after network errors
+func (r *RedisStore) cmd(args ...string) (reply interface{}, err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.conn == nil {
+		if err = r.dial(); err != nil {
+			return
+		}
+	}
+
+	if reply, err = r.do(args...); err != nil {
+		if _, ok := err.(redisError); !ok {
+			r.reset()
+		}
+	}
+
+	return
+}
+
+// do will write a command and read its reply, the caller must hold the lock
+func (r *RedisStore) do(args ...string) (reply interface{}, err error) {
+	if r.opts.Timeout > 0 {
+		r.conn.SetDeadline(time.Now().Add(r.opts.Timeout))
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	if _, err = r.conn.Write(buf); err != nil {
+		return
+	}
+
+	return readReply(r.rd)
+}
+
+// readReply will read a RESP reply, bulk strings are returned as strings and nil bulk strings as nil
+func readReply(rd *bufio.Reader) (reply interface{}, err error) {
+	var line string
+	if line, err = readLine(rd); err != nil {
+		return
+	}
+
+	if len(line) == 0 {
+		return nil, ErrRedisReply
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		var n int
+		if n, err = strconv.Atoi(line[1:]); err != nil || n < 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return
+		}
+
+		return string(b[:n]), nil
+
+	case '*':
+		var n int
+		if n, err = strconv.Atoi(line[1:]); err != nil || n < 0 {
+			return nil, err
+		}
+
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = readReply(rd); err != nil {
+				return
+			}
+		}
+
+		return out, nil
+	}
+
+	return nil, ErrRedisReply
+}
+
+func readLine(rd *bufio.Reader) (line string, err error) {
+	if line, err = rd.ReadString('\n'); err != nil {
+		return
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", ErrRedisReply
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// setOptions implements optionsSetter
+func (r *RedisStore) setOptions(o Options) {
+	r.mux.Lock()
+	r.sopts = o
+	r.mux.Unlock()
+}
+
+// expireAt will return when the keys of rec expire in unix milliseconds, the caller must hold the lock
+func (r *RedisStore) expireAt(rec *Record) int64 {
+	at := time.Unix(rec.deadline(&r.sopts), 0).Add(r.sopts.PurgeInterval * fullPurgeEvery)
+	return at.UnixNano() / int64(time.Millisecond)
+}
+
+func (r *RedisStore) recordKey(key string) string { return r.opts.Prefix + "s:" + key }
+func (r *RedisStore) uuidKey(uuid string) string  { return r.opts.Prefix + "u:" + uuid }
+
+// Get will return a session
+func (r *RedisStore) Get(key string) (rec *Record, err error) {
+	var reply interface{}
+	if reply, err = r.cmd("GET", r.recordKey(key)); err != nil {
+		return
+	}
+
+	return decodeRecord(reply)
+}
+
+func decodeRecord(reply interface{}) (rec *Record, err error) {
+	switch v := reply.(type) {
+	case nil:
+		return nil, ErrSessionDoesNotExist
+
+	case string:
+		rec = &Record{}
+		err = json.Unmarshal([]byte(v), rec)
+		return
+
+	default:
+		return nil, ErrRedisReply
+	}
+}
+
+// Put will create or replace a session
+func (r *RedisStore) Put(key string, rec *Record) (err error) {
+	var b []byte
+	if b, err = json.Marshal(rec); err != nil {
+		return
+	}
+
+	return r.update(key, func(old *Record) (cmds [][]string, nrec *Record, err error) {
+		if old != nil && old.UUID != rec.UUID {
+			cmds = append(cmds, []string{"SREM", r.uuidKey(old.UUID), key})
+		}
+
+		cmds = append(cmds,
+			[]string{"SET", r.recordKey(key), string(b)},
+			[]string{"SADD", r.uuidKey(rec.UUID), key},
+		)
+		return cmds, rec, nil
+	})
+}
+
+// Touch will set the last action of a session
+func (r *RedisStore) Touch(key string, lastAction int64) (err error) {
+	return r.update(key, func(rec *Record) (cmds [][]string, nrec *Record, err error) {
+		if rec == nil {
+			return nil, nil, ErrSessionDoesNotExist
+		}
+
+		rec.LastAction = lastAction
+
+		var b []byte
+		if b, err = json.Marshal(rec); err != nil {
+			return
+		}
+
+		return [][]string{{"SET", r.recordKey(key), string(b)}}, rec, nil
+	})
+}
+
+// Update will change a session atomically, see Updater
+func (r *RedisStore) Update(key string, fn func(rec *Record) error) (err error) {
+	return r.update(key, func(rec *Record) (cmds [][]string, nrec *Record, err error) {
+		if rec == nil {
+			return nil, nil, ErrSessionDoesNotExist
+		}
+
+		if err = fn(rec); err != nil {
+			return
+		}
+
+		var b []byte
+		if b, err = json.Marshal(rec); err != nil {
+			return
+		}
+
+		return [][]string{{"SET", r.recordKey(key), string(b)}}, rec, nil
+	})
+}
+
+// Delete will remove a session
+func (r *RedisStore) Delete(key string) (err error) {
+	return r.update(key, func(rec *Record) (cmds [][]string, nrec *Record, err error) {
+		if rec == nil {
+			return nil, nil, ErrSessionDoesNotExist
+		}
+
+		return [][]string{
+			{"DEL", r.recordKey(key)},
+			{"SREM", r.uuidKey(rec.UUID), key},
+		}, nil, nil
+	})
+}
+
+// update will run the commands returned by fn for the session of key, nil if it doesn't exist, in a
+// WATCH/MULTI/EXEC transaction. fn also returns the record it writes, if any, to set the expiry of its keys.
+// It is retried if the session was changed by another client in the meantime
+func (r *RedisStore) update(key string, fn func(rec *Record) ([][]string, *Record, error)) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		ok, ferr, err := r.tryUpdate(key, fn)
+		if err != nil {
+			// the connection may be left in a transaction
+			r.reset()
+			return err
+		}
+
+		if ferr != nil {
+			return ferr
+		}
+
+		if ok {
+			return nil
+		}
+	}
+}
+
+// tryUpdate will run a single attempt of update, it returns false if the transaction was aborted and the error
+// of fn as ferr
+func (r *RedisStore) tryUpdate(key string, fn func(rec *Record) ([][]string, *Record, error)) (ok bool, ferr, err error) {
+	rk := r.recordKey(key)
+	if _, err = r.do("WATCH", rk); err != nil {
+		return
+	}
+
+	var (
+		reply interface{}
+		rec   *Record
+	)
+
+	if reply, err = r.do("GET", rk); err != nil {
+		return
+	}
+
+	if rec, err = decodeRecord(reply); err == ErrSessionDoesNotExist {
+		rec, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	var (
+		cmds [][]string
+		nrec *Record
+	)
+
+	if cmds, nrec, ferr = fn(rec); ferr != nil {
+		_, err = r.do("UNWATCH")
+		return
+	}
+
+	if nrec != nil {
+		if cmds, err = r.expire(cmds, key, nrec); err != nil {
+			return
+		}
+	}
+
+	if _, err = r.do("MULTI"); err != nil {
+		return
+	}
+
+	for _, c := range cmds {
+		if _, err = r.do(c...); err != nil {
+			return
+		}
+	}
+
+	if reply, err = r.do("EXEC"); err != nil {
+		return
+	}
+
+	// a nil reply means a watched key changed
+	return reply != nil, nil, nil
+}
+
+// expire will append the commands setting the expiry of the keys of rec to cmds, the set of the uuid only
+// expires after all of its sessions so it is watched while its expiry is read
+func (r *RedisStore) expire(cmds [][]string, key string, rec *Record) (out [][]string, err error) {
+	var (
+		at = r.expireAt(rec)
+		uk = r.uuidKey(rec.UUID)
+
+		reply interface{}
+	)
+
+	out = append(cmds, []string{"PEXPIREAT", r.recordKey(key), strconv.FormatInt(at, 10)})
+
+	if _, err = r.do("WATCH", uk); err != nil {
+		return
+	}
+
+	if reply, err = r.do("PTTL", uk); err != nil {
+		return
+	}
+
+	ttl, ok := reply.(int64)
+	if !ok {
+		return nil, ErrRedisReply
+	}
+
+	// a negative ttl means the set has no expiry or doesn't exist yet
+	if ttl < 0 || time.Now().UnixNano()/int64(time.Millisecond)+ttl < at {
+		out = append(out, []string{"PEXPIREAT", uk, strconv.FormatInt(at, 10)})
+	}
+
+	return
+}
+
+// Keys will return the keys of the sessions of a uuid
+func (r *RedisStore) Keys(uuid string) (keys []string, err error) {
+	var reply interface{}
+	if reply, err = r.cmd("SMEMBERS", r.uuidKey(uuid)); err != nil {
+		return
+	}
+
+	return toStrings(reply)
+}
+
+// globEscaper escapes the special characters of the patterns of SCAN
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// ForEach will call fn with every session, the keys are iterated with SCAN
+func (r *RedisStore) ForEach(fn func(key string, rec *Record) error) (err error) {
+	var (
+		cursor = "0"
+		prefix = r.recordKey("")
+	)
+
+	for {
+		var reply interface{}
+		if reply, err = r.cmd("SCAN", cursor, "MATCH", globEscaper.Replace(prefix)+"*", "COUNT", "100"); err != nil {
+			return
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return ErrRedisReply
+		}
+
+		if cursor, ok = parts[0].(string); !ok {
+			return ErrRedisReply
+		}
+
+		var keys []string
+		if keys, err = toStrings(parts[1]); err != nil {
+			return
+		}
+
+		for _, rk := range keys {
+			key := rk[len(prefix):]
+
+			var rec *Record
+			if rec, err = r.Get(key); err == ErrSessionDoesNotExist {
+				continue
+			} else if err != nil {
+				return
+			}
+
+			if err = fn(key, rec); err != nil {
+				return
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Close will close the connection
+func (r *RedisStore) Close() (err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.conn == nil {
+		return
+	}
+
+	err = r.conn.Close()
+	r.conn, r.rd = nil, nil
+	return
+}
+
+func toStrings(reply interface{}) (out []string, err error) {
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrRedisReply, reply)
+	}
+
+	out = make([]string, 0, len(arr))
+	for _, v := range arr {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrRedisReply, v)
+		}
+		out = append(out, s)
+	}
+
+	return
+}
@@ -0,0 +1,441 @@
+package sessions
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server implementing the subset of the redis protocol used by RedisStore
+type fakeRedis struct {
+	ln net.Listener
+
+	mux  sync.Mutex
+	strs map[string]string
+	sets map[string]map[string]struct{}
+	// vers is bumped on every write of a key, for WATCH
+	vers map[string]int
+	// exps are the expiries of the keys in unix milliseconds, the keys aren't actually expired
+	exps map[string]int64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{ln: ln, strs: map[string]string{}, sets: map[string]map[string]struct{}{}, vers: map[string]int{}, exps: map[string]int64{}}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) Addr() string { return f.ln.Addr().String() }
+func (f *fakeRedis) Close()       { f.ln.Close() }
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		rd = bufio.NewReader(conn)
+		w  = bufio.NewWriter(conn)
+
+		// the transaction state of the connection
+		watched map[string]int
+		queued  [][]string
+		multi   bool
+	)
+
+	for {
+		reply, err := readReply(rd)
+		if err != nil {
+			return
+		}
+
+		args, err := toStrings(reply)
+		if err != nil || len(args) == 0 {
+			return
+		}
+
+		f.mux.Lock()
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "WATCH":
+			if watched == nil {
+				watched = map[string]int{}
+			}
+
+			for _, k := range args[1:] {
+				watched[k] = f.vers[k]
+			}
+			w.WriteString("+OK\r\n")
+
+		case cmd == "UNWATCH":
+			watched = nil
+			w.WriteString("+OK\r\n")
+
+		case cmd == "MULTI":
+			multi = true
+			w.WriteString("+OK\r\n")
+
+		case cmd == "EXEC":
+			f.execMulti(w, watched, queued)
+			watched, queued, multi = nil, nil, false
+
+		case multi:
+			queued = append(queued, args)
+			w.WriteString("+QUEUED\r\n")
+
+		default:
+			f.exec(w, cmd, args[1:])
+		}
+		f.mux.Unlock()
+
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// execMulti will run the queued commands of a transaction unless one of the watched keys was written
+func (f *fakeRedis) execMulti(w *bufio.Writer, watched map[string]int, queued [][]string) {
+	for k, v := range watched {
+		if f.vers[k] != v {
+			w.WriteString("*-1\r\n")
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "*%d\r\n", len(queued))
+	for _, args := range queued {
+		f.exec(w, strings.ToUpper(args[0]), args[1:])
+	}
+}
+
+func (f *fakeRedis) exec(w *bufio.Writer, cmd string, args []string) {
+	switch cmd {
+	case "PING", "AUTH", "SELECT":
+		w.WriteString("+OK\r\n")
+
+	case "GET":
+		if v, ok := f.strs[args[0]]; ok {
+			writeBulk(w, v)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+
+	case "SET":
+		if _, ok := f.strs[args[0]]; !ok && len(args) > 2 && strings.ToUpper(args[2]) == "XX" {
+			w.WriteString("$-1\r\n")
+			return
+		}
+
+		f.strs[args[0]] = args[1]
+		f.vers[args[0]]++
+		w.WriteString("+OK\r\n")
+
+	case "DEL":
+		var n int
+		for _, k := range args {
+			if _, ok := f.strs[k]; ok {
+				delete(f.strs, k)
+				delete(f.exps, k)
+				f.vers[k]++
+				n++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+
+	case "SADD":
+		s, ok := f.sets[args[0]]
+		if !ok {
+			s = map[string]struct{}{}
+			f.sets[args[0]] = s
+		}
+
+		for _, m := range args[1:] {
+			s[m] = struct{}{}
+		}
+		f.vers[args[0]]++
+		fmt.Fprintf(w, ":%d\r\n", len(args)-1)
+
+	case "SREM":
+		s := f.sets[args[0]]
+		for _, m := range args[1:] {
+			delete(s, m)
+		}
+
+		if len(s) == 0 {
+			delete(f.sets, args[0])
+			delete(f.exps, args[0])
+		}
+		f.vers[args[0]]++
+		fmt.Fprintf(w, ":%d\r\n", len(args)-1)
+
+	case "PEXPIREAT":
+		if !f.exists(args[0]) {
+			w.WriteString(":0\r\n")
+			return
+		}
+
+		at, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.WriteString("-ERR value is not an integer\r\n")
+			return
+		}
+
+		f.exps[args[0]] = at
+		f.vers[args[0]]++
+		w.WriteString(":1\r\n")
+
+	case "PTTL":
+		at, ok := f.exps[args[0]]
+		switch {
+		case !f.exists(args[0]):
+			w.WriteString(":-2\r\n")
+		case !ok:
+			w.WriteString(":-1\r\n")
+		default:
+			fmt.Fprintf(w, ":%d\r\n", at-time.Now().UnixNano()/int64(time.Millisecond))
+		}
+
+	case "SMEMBERS":
+		var ms []string
+		for m := range f.sets[args[0]] {
+			ms = append(ms, m)
+		}
+		writeArray(w, ms)
+
+	case "SCAN":
+		// a single page, args are: cursor MATCH pattern COUNT n
+		var keys []string
+		for k := range f.strs {
+			if ok, _ := path.Match(args[2], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		w.WriteString("*2\r\n")
+		writeBulk(w, "0")
+		writeArray(w, keys)
+
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", cmd)
+	}
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	_, ok := f.strs[key]
+	_, sok := f.sets[key]
+	return ok || sok
+}
+
+// expiry will return the expiry of a key, zero if it has none
+func (f *fakeRedis) expiry(key string) time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	at, ok := f.exps[key]
+	if !ok {
+		return time.Time{}
+	}
+
+	return time.Unix(0, at*int64(time.Millisecond))
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeArray(w *bufio.Writer, ss []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(ss))
+	for _, s := range ss {
+		writeBulk(w, s)
+	}
+}
+
+func TestRedisShared(t *testing.T) {
+	srv := newFakeRedis(t)
+	defer srv.Close()
+
+	// the replicas share the secret of the hashes
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	open := func() *Sessions {
+		st, err := NewRedisStore(srv.Addr(), RedisOptions{Password: "secret", DB: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustNew(t, "", Options{Store: st, Secret: secret})
+	}
+
+	a, b := open(), open()
+	defer a.Close()
+	defer b.Close()
+
+	token, key, err := a.NewWithOptions(testUser1, SessionOptions{UserAgent: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session created by one replica is valid on the others
+	if uuid, err := b.Get(token, key); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if list, err := b.ListByUUID(testUser1); err != nil || len(list) != 1 || list[0].UserAgent != "phone" {
+		t.Fatalf("unexpected sessions: %+v %v", list, err)
+	}
+
+	if err = b.Delete(token, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Get(token, key); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if err = a.store.Touch(a.storeKey(token), 1); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+}
+
+func TestRedisRotateTouch(t *testing.T) {
+	srv := newFakeRedis(t)
+	defer srv.Close()
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	// separate stores so the replicas don't share a connection
+	open := func() *Sessions {
+		st, err := NewRedisStore(srv.Addr(), RedisOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustNew(t, "", Options{Store: st, Secret: secret, RotationGrace: time.Minute})
+	}
+
+	a, b := open(), open()
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 50; i++ {
+		token, key := a.New(testUser1)
+		sk := a.storeKey(token)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := int64(1); n <= 10; n++ {
+				if err := b.store.Touch(sk, time.Now().Unix()+n); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		if _, _, err := a.Rotate(token, key); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		// a touch must not write back the record from before the rotation
+		r, err := a.store.Get(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Successor == "" {
+			t.Fatalf("%d: the rotation was lost: %+v", i, r)
+		}
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	srv := newFakeRedis(t)
+	defer srv.Close()
+
+	open := func(prefix string) *Sessions {
+		st, err := NewRedisStore(srv.Addr(), RedisOptions{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustNew(t, "", Options{Store: st, Secret: testSecret, IdleTimeout: time.Hour, PurgeInterval: time.Second})
+	}
+
+	// the glob characters of the prefix must not match the keys of the other prefix
+	a, b := open("a[1]*:"), open("a1xyz:")
+	defer a.Close()
+	defer b.Close()
+
+	token, _ := a.New(testUser1)
+	b.New(testUser1)
+
+	var (
+		rs  = a.store.(*RedisStore)
+		rk  = rs.recordKey(a.storeKey(token))
+		uk  = rs.uuidKey(testUser1)
+		exp = time.Now().Add(time.Hour + fullPurgeEvery*time.Second)
+	)
+
+	within := func(got, exp time.Time) bool {
+		d := got.Sub(exp)
+		return d > -5*time.Second && d < 5*time.Second
+	}
+
+	if got := srv.expiry(rk); !within(got, exp) {
+		t.Fatalf("expected the session to expire at %v, got %v", exp, got)
+	}
+
+	if got := srv.expiry(uk); !within(got, exp) {
+		t.Fatalf("expected the uuid set to expire at %v, got %v", exp, got)
+	}
+
+	if err := rs.Touch(a.storeKey(token), time.Now().Unix()+100); err != nil {
+		t.Fatal(err)
+	}
+
+	exp = exp.Add(100 * time.Second)
+	if got := srv.expiry(rk); !within(got, exp) {
+		t.Fatalf("expected the touched session to expire at %v, got %v", exp, got)
+	}
+
+	// a shorter session doesn't shorten the expiry of the uuid set
+	if _, _, err := a.NewWithOptions(testUser1, SessionOptions{IdleTimeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.expiry(uk); !within(got, exp) {
+		t.Fatalf("expected the uuid set to expire at %v, got %v", exp, got)
+	}
+
+	var n int
+	if err := rs.ForEach(func(key string, r *Record) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Fatalf("expected 2 sessions, got %d", n)
+	}
+}
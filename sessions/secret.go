@@ -0,0 +1,211 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	secretName = "sessions.secret"
+	secretSize = 32
+
+	// legacySep separates the token and key in the store keys of old snapshots, which held the raw secrets
+	legacySep = "::"
+)
+
+// loadSecret will read the secret of dir, creating it if it doesn't exist
+func loadSecret(dir string) (secret []byte, err error) {
+	name := filepath.Join(dir, secretName)
+	if secret, err = ioutil.ReadFile(name); err == nil {
+		if len(secret) < secretSize {
+			err = ErrInvalidSecret
+		}
+		return
+	}
+
+	if !os.IsNotExist(err) {
+		return
+	}
+
+	if secret, err = newSecret(); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0744); err != nil {
+		return
+	}
+
+	// O_EXCL so two processes sharing dir don't overwrite each other's secret
+	var f *os.File
+	if f, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		if os.IsExist(err) {
+			return loadSecret(dir)
+		}
+		return
+	}
+
+	if _, err = f.Write(secret); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return
+}
+
+func newSecret() (secret []byte, err error) {
+	secret = make([]byte, secretSize)
+	_, err = rand.Read(secret)
+	return
+}
+
+// mac will return the hex HMAC of v for a purpose
+func (s *Sessions) mac(purpose, v string) string {
+	// setting up an HMAC costs about as much as hashing a token with it, they are reused
+	m, _ := s.macs.Get().(hash.Hash)
+	if m == nil {
+		m = hmac.New(sha256.New, s.secret)
+	}
+
+	m.Reset()
+	m.Write([]byte(purpose))
+	m.Write([]byte{0})
+	m.Write([]byte(v))
+
+	var sum [sha256.Size]byte
+	out := hex.EncodeToString(m.Sum(sum[:0]))
+	s.macs.Put(m)
+	return out
+}
+
+// storeKey will return the store key of a token
+func (s *Sessions) storeKey(token string) string {
+	return s.mac("token", token)
+}
+
+// keyHash will return the hash of a key which is kept in its Record
+func (s *Sessions) keyHash(key string) string {
+	return s.mac("key", key)
+}
+
+// checkKey will compare key to the hash of a record in constant time
+func (s *Sessions) checkKey(r *Record, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.KeyHash), []byte(s.keyHash(key))) == 1
+}
+
+// parentCipher will return the cipher sealing the parent session of an impersonation session, it is derived from
+// the impersonation session's key so the parent's token/key pair can't be read without it
+func (s *Sessions) parentCipher(key string) (aead cipher.AEAD, err error) {
+	k, _ := hex.DecodeString(s.mac("parent", key))
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(k); err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealParent will encrypt the token/key pair of the parent session with the key of the impersonation session
+func (s *Sessions) sealParent(key, ptoken, pkey string) (sealed string, err error) {
+	var aead cipher.AEAD
+	if aead, err = s.parentCipher(key); err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	b := aead.Seal(nonce, nonce, []byte(ptoken+legacySep+pkey), nil)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openParent is the reverse of sealParent
+func (s *Sessions) openParent(key, sealed string) (ptoken, pkey string, err error) {
+	var aead cipher.AEAD
+	if aead, err = s.parentCipher(key); err != nil {
+		return
+	}
+
+	var b []byte
+	if b, err = base64.RawURLEncoding.DecodeString(sealed); err != nil {
+		return
+	}
+
+	if len(b) < aead.NonceSize() {
+		err = ErrSessionDoesNotExist
+		return
+	}
+
+	if b, err = aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil); err != nil {
+		err = ErrSessionDoesNotExist
+		return
+	}
+
+	parts := strings.SplitN(string(b), legacySep, 2)
+	if len(parts) != 2 {
+		err = ErrSessionDoesNotExist
+		return
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// migrate will rehash the sessions stored under the raw token/key pairs of old snapshots
+func (s *Sessions) migrate() (n int, err error) {
+	var legacy []string
+	if err = s.store.ForEach(func(key string, r *Record) error {
+		if strings.Contains(key, legacySep) {
+			legacy = append(legacy, key)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	for _, old := range legacy {
+		var r *Record
+		if r, err = s.store.Get(old); err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		parts := strings.SplitN(old, legacySep, 2)
+		token, key := parts[0], parts[1]
+
+		r.KeyHash = s.keyHash(key)
+
+		if err = s.store.Put(s.storeKey(token), r); err != nil {
+			return
+		}
+
+		if err = s.store.Delete(old); err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+
+		n++
+	}
+
+	if c, ok := s.store.(interface{ Compact() error }); ok && n > 0 {
+		// don't leave the raw secrets in the snapshot or the log
+		err = c.Compact()
+	}
+
+	return
+}
@@ -0,0 +1,90 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecret(t *testing.T) {
+	const dir = "./test_data_secret"
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot from before the secrets were hashed
+	now := time.Now().Unix()
+	legacy := map[string]*Record{
+		"tok1::key1": {ID: "id1", UUID: testUser1, LastAction: now, CreatedAt: now},
+		"tok2::key2": {ID: "id2", UUID: testUser2, LastAction: now, CreatedAt: now, Expires: now + 60},
+	}
+
+	b, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, snapshotName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := mustNew(t, dir, Options{})
+
+	if uuid, err := s.Get("tok1", "key1"); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if _, err = s.Get("tok1", "key2"); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if b, err = ioutil.ReadFile(filepath.Join(dir, snapshotName)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range []string{"tok1", "key1", "tok2", "key2"} {
+		if bytes.Contains(b, []byte(raw)) {
+			t.Fatalf("the snapshot still contains %q: %s", raw, b)
+		}
+	}
+
+	if uuid, err := s.Get("tok2", "key2"); err != nil || uuid != testUser2 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	token, key := s.New(testUser3)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the secret is kept with the snapshot
+	s = mustNew(t, dir, Options{})
+	defer s.Close()
+
+	if uuid, err := s.Get(token, key); err != nil || uuid != testUser3 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	// a different secret doesn't match the hashes
+	other := mustNew(t, "", Options{Store: s.store, Secret: testSecret})
+	if _, err = other.Get(token, key); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+	stop(other)
+
+	// a shared store needs the secret of the other instances
+	ts, err := NewTurtleStore(filepath.Join(dir, "turtle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewWithOptions("", Options{Store: ts}); err != ErrNoSecret {
+		t.Fatalf("expected ErrNoSecret, got %v", err)
+	}
+}
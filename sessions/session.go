@@ -2,16 +2,164 @@ package sessions
 
 import (
 	"time"
-
-	"github.com/PathDNA/atoms"
 )
 
-type session struct {
+// Record is a session as it is kept by a Store, its map key is derived from the token/key pair
+type Record struct {
+	// ID is a stable identifier of the session that, unlike the token/key pair, can be shown to users
+	ID   string `json:"id"`
 	UUID string `json:"uuid"`
-	// Last action taken for this session
-	LastAction atoms.Int64 `json:"lastAction"`
+	// KeyHash is the keyed hash of the session key, the store key is the keyed hash of the token
+	KeyHash string `json:"keyHash,omitempty"`
+	// CreatedAt is when the session was created (unix seconds)
+	CreatedAt int64 `json:"createdAt,omitempty"`
+	// Last action taken for this session (unix seconds)
+	LastAction int64 `json:"lastAction"`
+	// IssuedAt is when the token/key pair was issued (unix seconds), it differs from CreatedAt once the session
+	// is rotated
+	IssuedAt int64 `json:"issuedAt,omitempty"`
+
+	// Successor is the store key of the pair which replaced this one, see Sessions.Rotate.
+	// The pair keeps working until GraceUntil (unix seconds) as long as its successor exists
+	Successor  string `json:"successor,omitempty"`
+	GraceUntil int64  `json:"graceUntil,omitempty"`
+
+	// IdleTimeout and MaxLifetime (in seconds) override the Options of Sessions when they are set, see SessionOptions
+	IdleTimeout int64 `json:"idleTimeout,omitempty"`
+	MaxLifetime int64 `json:"maxLifetime,omitempty"`
+
+	// Impersonator is the UUID of the user acting as UUID, see Sessions.Impersonate
+	Impersonator string `json:"impersonator,omitempty"`
+	// Parent is the token/key pair of the impersonator's own session, sealed with the key of this session
+	Parent string `json:"parent,omitempty"`
+	// Impersonations are the store keys of the impersonation sessions started from this session, they are
+	// removed along with it
+	Impersonations []string `json:"impersonations,omitempty"`
+
+	// Expires is the absolute expiry of the session (unix seconds), zero means it only expires from inactivity
+	Expires int64 `json:"expires,omitempty"`
+
+	// Client information and app values, see SessionOptions
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Values    map[string]string `json:"values,omitempty"`
+}
+
+// expires will return the absolute expiry of the session, zero if it has none
+func (s *Record) expires(maxLifetime int64) (exp int64) {
+	if s.MaxLifetime > 0 {
+		maxLifetime = s.MaxLifetime
+	}
+
+	if maxLifetime > 0 {
+		exp = s.CreatedAt + maxLifetime
+	}
+
+	if s.Expires > 0 && (exp == 0 || s.Expires < exp) {
+		exp = s.Expires
+	}
+
+	return
+}
+
+// dup will return a copy of the record
+func (s *Record) dup() *Record {
+	out := *s
+	out.Impersonations = append([]string(nil), s.Impersonations...)
+	if s.Values != nil {
+		out.Values = make(map[string]string, len(s.Values))
+		for k, v := range s.Values {
+			out.Values[k] = v
+		}
+	}
+
+	return &out
+}
+
+// public will return the public information of the session
+func (s *Record) public(maxLifetime int64) (out Session) {
+	out.ID = s.ID
+	out.UUID = s.UUID
+	out.Impersonator = s.Impersonator
+	if exp := s.expires(maxLifetime); exp > 0 {
+		out.Expires = time.Unix(exp, 0)
+	}
+
+	out.Created = time.Unix(s.CreatedAt, 0)
+	out.Issued = time.Unix(s.issued(), 0)
+	out.LastAction = time.Unix(s.LastAction, 0)
+	out.IP = s.IP
+	out.UserAgent = s.UserAgent
+
+	if s.Values != nil {
+		out.Values = make(map[string]string, len(s.Values))
+		for k, v := range s.Values {
+			out.Values[k] = v
+		}
+	}
+
+	return
+}
+
+// issued will return when the token/key pair was issued
+func (s *Record) issued() int64 {
+	if s.IssuedAt > 0 {
+		return s.IssuedAt
+	}
+
+	return s.CreatedAt
+}
+
+// idle will return the idle timeout of the session in seconds
+func (s *Record) idle(o *Options) int64 {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+
+	return int64(o.IdleTimeout / time.Second)
+}
+
+// deadline will return when the session ends without further activity
+func (s *Record) deadline(o *Options) (at int64) {
+	at = s.LastAction + s.idle(o)
+	if exp := s.expires(int64(o.MaxLifetime / time.Second)); exp > 0 && exp < at {
+		at = exp
+	}
+
+	if s.GraceUntil > 0 && s.GraceUntil < at {
+		at = s.GraceUntil
+	}
+
+	return
+}
+
+// alive will return if the session is neither idle for longer than its idle timeout nor past its absolute expiry,
+// nor a rotated pair past its grace window
+func (s *Record) alive(now int64, o *Options) bool {
+	return s.deadline(o) > now
+}
+
+// Session is the public information of a session
+type Session struct {
+	ID   string
+	UUID string
+	// Impersonator is the UUID of the real user if this is an impersonation session
+	Impersonator string
+	// Expires is the absolute expiry of the session, zero if it only expires from inactivity
+	Expires time.Time
+
+	Created time.Time
+	// Issued is when the current token/key pair was issued, for rotating sessions at an interval
+	Issued time.Time
+	// LastAction is written at most every Options.TouchInterval
+	LastAction time.Time
+
+	IP        string
+	UserAgent string
+	Values    map[string]string
 }
 
-func (s *session) setAction() {
-	s.LastAction.Store(time.Now().Unix())
+// IsImpersonation will return if the session is an impersonation session
+func (s *Session) IsImpersonation() bool {
+	return s.Impersonator != ""
 }
@@ -1,9 +1,9 @@
 package sessions
 
 import (
-	"encoding/json"
-	"os"
-	"path/filepath"
+	"context"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/PathDNA/atoms"
@@ -14,135 +14,865 @@ import (
 const (
 	// ErrSessionDoesNotExist is returned when an invalid token/key pair is presented
 	ErrSessionDoesNotExist = errors.Error("session with that token/key pair does not exist")
+	// ErrNotImpersonating is returned when ending a session that isn't an impersonation session
+	ErrNotImpersonating = errors.Error("session is not an impersonation session")
+	// ErrNestedImpersonation is returned when impersonating from an impersonation session
+	ErrNestedImpersonation = errors.Error("can't impersonate from an impersonation session")
+	// ErrSessionRotated is returned when rotating or ending a token/key pair which was already rotated
+	ErrSessionRotated = errors.Error("session token/key pair was rotated")
+	// ErrTooManySessions is returned when a uuid is at the session limit, see Options.MaxSessions
+	ErrTooManySessions = errors.Error("too many sessions")
+	// ErrInvalidSecret is returned when the secret file of the sessions is too short
+	ErrInvalidSecret = errors.Error("invalid sessions secret")
+	// ErrCorruptLog is returned when a record of the session log of a file store can't be read
+	ErrCorruptLog = errors.Error("corrupt session log")
+	// ErrNoSecret is returned when a shared store is used without a secret, see Options.Secret
+	ErrNoSecret = errors.Error("sessions secret required for a store without a directory")
 )
 
 const (
-	// SessionTimeout (in seconds) is the ttl for sessions, an action will refresh the duration
+	// SessionTimeout (in seconds) is the default idle timeout of sessions, an action will refresh the duration
 	SessionTimeout = 60 * 60 * 12 // 12 hours
+
+	// DefaultPurgeInterval is the default interval between purges of the expired sessions
+	DefaultPurgeInterval = time.Minute
+
+	// DefaultTouchInterval is the default minimum time between two writes of the last action of a session
+	DefaultTouchInterval = 10 * time.Second
+	// fullPurgeEvery is the number of purge intervals between two scans of the whole store, for the sessions
+	// created by other instances sharing the store
+	fullPurgeEvery = 60
+
+	// DefaultRotationGrace is the default time a rotated token/key pair keeps working, see Sessions.Rotate
+	DefaultRotationGrace = 30 * time.Second
 )
 
+// Options are the settings of Sessions, zero values are replaced by the defaults
+type Options struct {
+	// IdleTimeout is how long a session lasts without activity, defaults to SessionTimeout
+	IdleTimeout time.Duration
+	// MaxLifetime is how long a session lasts regardless of activity, zero means no limit
+	MaxLifetime time.Duration
+	// PurgeInterval is the interval between purges of the expired sessions, defaults to DefaultPurgeInterval
+	PurgeInterval time.Duration
+	// TouchInterval is the minimum time between two writes of the last action of a session, defaults to
+	// DefaultTouchInterval. It is capped to a quarter of the idle timeout of the session, which can end that much
+	// earlier than it would with a write on every request
+	TouchInterval time.Duration
+	// MaxSessions is the number of sessions a uuid can have at once, zero means no limit.
+	// The impersonation sessions don't count, see LimitPolicy for what happens at the limit
+	MaxSessions int
+	// LimitPolicy is what happens to a new session of a uuid which has MaxSessions sessions
+	LimitPolicy LimitPolicy
+	// RotationGrace is how long a rotated token/key pair keeps working, defaults to DefaultRotationGrace.
+	// A negative value ends the old pair right away
+	RotationGrace time.Duration
+
+	// Store is where the sessions are kept, it is closed by Sessions.Close.
+	// It defaults to a file store in the directory passed to NewWithOptions, see NewFileStore
+	Store Store
+	// File are the settings of the default file store
+	File FileOptions
+
+	// Secret is the key of the hashes of the tokens and keys, the stores only keep their hashes.
+	// It defaults to a random secret kept in the directory passed to NewWithOptions. Without a directory it is
+	// required unless Store is a memory only store, as Sessions sharing a store must share the secret
+	Secret []byte
+}
+
+// SessionOptions are the settings of a single session, the timeouts override the Options of Sessions,
+// for example for "remember me" sessions
+type SessionOptions struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+
+	// IP and UserAgent describe the client, for listing the sessions of a user
+	IP        string
+	UserAgent string
+	// Values are arbitrary app values
+	Values map[string]string
+}
+
 const (
 	snapshotName = "sessions.db"
 )
 
 // New will return a new instance of sessions
-func New(dir string) *Sessions {
+func New(dir string) (*Sessions, error) {
+	return NewWithOptions(dir, Options{})
+}
+
+// NewWithOptions will return a new instance of sessions using the provided options
+func NewWithOptions(dir string, opts Options) (*Sessions, error) {
+	return NewWithContext(context.Background(), dir, opts)
+}
+
+// NewWithContext will return a new instance of sessions which is closed when ctx is done.
+// The sessions are kept in memory only when both dir and opts.Store are empty
+func NewWithContext(ctx context.Context, dir string, opts Options) (sp *Sessions, err error) {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = time.Second * SessionTimeout
+	}
+
+	if opts.PurgeInterval <= 0 {
+		opts.PurgeInterval = DefaultPurgeInterval
+	}
+
+	if opts.TouchInterval <= 0 {
+		opts.TouchInterval = DefaultTouchInterval
+	}
+
+	if opts.RotationGrace == 0 {
+		opts.RotationGrace = DefaultRotationGrace
+	}
+
+	if opts.Store != nil && opts.Secret == nil && dir == "" {
+		if ms, ok := opts.Store.(*MemoryStore); !ok || ms.dir != "" {
+			opts.Store.Close()
+			err = ErrNoSecret
+			return
+		}
+	}
+
+	if opts.Store == nil {
+		if dir == "" {
+			opts.Store = NewMemoryStore()
+		} else if opts.Store, err = NewFileStore(dir, opts.File); err != nil {
+			return
+		}
+	}
+
 	var s Sessions
-	s.dir = dir
+	s.opts = opts
+	s.store = opts.Store
 	s.g = uuid.NewGen()
-	s.m = make(map[string]*session)
-	// Load from snapshot
-	s.load()
+
+	if st, ok := s.store.(optionsSetter); ok {
+		st.setOptions(opts)
+	}
+
+	if s.secret = opts.Secret; s.secret == nil {
+		if dir == "" {
+			s.secret, err = newSecret()
+		} else {
+			s.secret, err = loadSecret(dir)
+		}
+	}
+
+	if err == nil {
+		// Hash the secrets of old snapshots
+		_, err = s.migrate()
+	}
+
+	if err != nil {
+		s.store.Close()
+		return
+	}
+
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
 	// Start purge loop
-	go s.loop()
-	return &s
+	go s.run()
+	return &s, nil
 }
 
 // Sessions manages sessions
 type Sessions struct {
-	mux atoms.RWMux
+	opts   Options
+	store  Store
+	secret []byte
+	// macs are the HMACs keyed with secret, see mac
+	macs sync.Pool
+
+	// mux serializes the creation of sessions when they are limited
+	mux sync.Mutex
+	// umux serializes the updates of stores which aren't an Updater, see update
+	umux sync.Mutex
+	g    *uuid.Gen
 
-	dir string
+	// exp is the expiry of the sessions known to this instance, see Purge
+	exp expiry
 
-	g *uuid.Gen
-	m map[string]*session
+	// the purge loop runs until ctx is done, done is closed once it stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
 
 	closed atoms.Bool
+	// closeErr is the error of closing the store once the parent context is done, it is returned by the next Close
+	closeErr  error
+	ctxClosed atoms.Bool
+}
+
+func (s *Sessions) run() {
+	defer close(s.done)
+	s.loop()
+
+	// the parent context is done, Close wasn't called
+	if s.closed.Set(true) {
+		s.closeErr = s.store.Close()
+		s.ctxClosed.Set(true)
+	}
 }
 
 func (s *Sessions) loop() {
-	for !s.closed.Get() {
-		oldest := time.Now().Add(time.Second * -SessionTimeout).Unix()
-		s.Purge(oldest)
-		time.Sleep(time.Minute)
+	t := time.NewTicker(s.opts.PurgeInterval)
+	defer t.Stop()
+
+	for i := 0; ; i++ {
+		if i%fullPurgeEvery == 0 {
+			s.Purge(0)
+		} else {
+			s.expire()
+		}
+
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
 	}
 }
 
-// Purge will purge all entries oldest than the oldest value
-func (s *Sessions) Purge(oldest int64) {
-	s.mux.Update(func() {
-		for key, ss := range s.m {
-			if ss.LastAction.Load() < oldest {
-				delete(s.m, key)
-			}
+// isClosed will return ErrIsClosed once the instance is closed
+func (s *Sessions) isClosed() error {
+	if s.closed.Get() {
+		return errors.ErrIsClosed
+	}
+
+	return nil
+}
+
+// maxLifetime will return the default max lifetime in seconds
+func (s *Sessions) maxLifetime() int64 {
+	return int64(s.opts.MaxLifetime / time.Second)
+}
+
+// Purge will purge all entries oldest than the oldest value, as well as the expired sessions.
+// It scans the whole store, the purge loop only visits the sessions which are due most of the time
+func (s *Sessions) Purge(oldest int64) (err error) {
+	if err = s.isClosed(); err != nil {
+		return
+	}
+
+	var (
+		now  = time.Now().Unix()
+		keys []string
+		rs   []*Record
+	)
+
+	if err = s.store.ForEach(func(key string, r *Record) error {
+		if r.LastAction < oldest || !r.alive(now, &s.opts) {
+			keys = append(keys, key)
+			rs = append(rs, r)
+		} else {
+			s.exp.push(key, r.deadline(&s.opts))
 		}
-	})
+		return nil
+	}); err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		if err = s.remove(key, rs[i]); err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+	}
+
+	return nil
+}
+
+// expire will remove the sessions which are due for expiry
+func (s *Sessions) expire() (err error) {
+	now := time.Now().Unix()
+	for _, key := range s.exp.due(now) {
+		r, err := s.store.Get(key)
+		if err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
+			// try again on the next purge
+			s.exp.push(key, now+1)
+			return err
+		}
+
+		if r.alive(now, &s.opts) {
+			// the session was active since it was pushed
+			s.exp.push(key, r.deadline(&s.opts))
+			continue
+		}
+
+		if err = s.remove(key, r); err != nil && err != ErrSessionDoesNotExist {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// put will store a session and schedule its expiry
+func (s *Sessions) put(key string, r *Record) (err error) {
+	if err = s.store.Put(key, r); err != nil {
+		return
+	}
+
+	s.exp.push(key, r.deadline(&s.opts))
+	return
 }
 
-// New will creata  new token/key pair
+// touchInterval will return the minimum number of seconds between two writes of the last action of a session
+func (s *Sessions) touchInterval(r *Record) (n int64) {
+	n = int64(s.opts.TouchInterval / time.Second)
+	if q := r.idle(&s.opts) / 4; q < n {
+		n = q
+	}
+
+	// the last action has a one second resolution
+	if n < 1 {
+		n = 1
+	}
+
+	return
+}
+
+// New will create a new token/key pair, errors are dropped and token and key are empty after one, this includes
+// errors.ErrIsClosed once the instance is closed. Use NewWithOptions to handle them
 func (s *Sessions) New(uuid string) (token, key string) {
-	var ss session
-	ss.UUID = uuid
-	ss.setAction()
+	token, key, _ = s.NewWithOptions(uuid, SessionOptions{})
+	return
+}
+
+// NewWithOptions will create a new token/key pair for a session with its own timeouts and client information
+func (s *Sessions) NewWithOptions(uuid string, opts SessionOptions) (token, key string, err error) {
+	if err = s.isClosed(); err != nil {
+		return
+	}
+
+	var r Record
+	r.ID = s.g.New().String()
+	r.UUID = uuid
+	r.IdleTimeout = int64(opts.IdleTimeout / time.Second)
+	r.MaxLifetime = int64(opts.MaxLifetime / time.Second)
+	r.IP = opts.IP
+	r.UserAgent = opts.UserAgent
+	if len(opts.Values) > 0 {
+		r.Values = make(map[string]string, len(opts.Values))
+		for k, v := range opts.Values {
+			r.Values[k] = v
+		}
+	}
+	r.LastAction = time.Now().Unix()
+	r.CreatedAt = r.LastAction
 
 	// Set token
 	token = s.g.New().String()
 	// Set key
 	key = s.g.New().String()
+	r.KeyHash = s.keyHash(key)
 
-	s.mux.Update(func() {
-		s.m[getMapKey(token, key)] = &ss
-	})
+	if s.opts.MaxSessions > 0 {
+		// counting and creating must not interleave
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if err = s.makeRoom(uuid); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err = s.put(s.storeKey(token), &r); err != nil {
+		return "", "", err
+	}
+
+	return
+}
+
+// lookup will return the session of a token/key pair
+func (s *Sessions) lookup(token, key string) (sk string, r *Record, err error) {
+	if err = s.isClosed(); err != nil {
+		return
+	}
+
+	sk = s.storeKey(token)
+	if r, err = s.store.Get(sk); err != nil {
+		return
+	}
+
+	if !s.checkKey(r, key) {
+		return "", nil, ErrSessionDoesNotExist
+	}
+
+	return
+}
+
+// get will return the active session of a token/key pair and refresh its last action
+func (s *Sessions) get(token, key string) (r *Record, err error) {
+	var sk string
+	if sk, r, err = s.lookup(token, key); err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	if !r.alive(now, &s.opts) {
+		return nil, ErrSessionDoesNotExist
+	}
+
+	if r.Successor != "" {
+		// the rotated pair ends with its successor, for example on logout
+		if _, err = s.store.Get(r.Successor); err != nil {
+			return nil, err
+		}
+	}
+
+	// the writes of the last action are coalesced
+	if now-r.LastAction >= s.touchInterval(r) {
+		r.LastAction = now
+		if err = s.store.Touch(sk, now); err != nil {
+			return nil, err
+		}
+	}
 
 	return
 }
 
-// Get will retrieve the UUID associated with a provided token/key pair
+// Get will retrieve the UUID associated with a provided token/key pair.
+// It doesn't tell impersonation sessions apart, use GetSession and Session.IsImpersonation before changing
+// the credentials of the user, or auth.Auth.SessionActor which checks it.
 func (s *Sessions) Get(token, key string) (uuid string, err error) {
+	var r *Record
+	if r, err = s.get(token, key); err != nil {
+		return
+	}
+
+	return r.UUID, nil
+}
+
+// GetSession will retrieve the session associated with a provided token/key pair, Session.Impersonator is set
+// for impersonation sessions
+func (s *Sessions) GetSession(token, key string) (out Session, err error) {
+	var r *Record
+	if r, err = s.get(token, key); err != nil {
+		return
+	}
+
+	return r.public(s.maxLifetime()), nil
+}
+
+// Impersonate will create a token/key pair for acting as uuid from the session of token/key, the new session
+// expires after ttl regardless of activity and is removed along with the session of token/key.
+// Permission checks are up to the caller, see auth.Auth.Impersonate
+func (s *Sessions) Impersonate(token, key, uuid string, ttl time.Duration) (itoken, ikey string, err error) {
+	var pr *Record
+	if pr, err = s.get(token, key); err != nil {
+		return
+	}
+
+	if pr.Impersonator != "" {
+		err = ErrNestedImpersonation
+		return
+	}
+
+	var r Record
+	r.ID = s.g.New().String()
+	r.UUID = uuid
+	r.Impersonator = pr.UUID
+	r.LastAction = time.Now().Unix()
+	r.CreatedAt = r.LastAction
+	r.Expires = time.Now().Add(ttl).Unix()
+
+	itoken = s.g.New().String()
+	ikey = s.g.New().String()
+	r.KeyHash = s.keyHash(ikey)
+
+	if r.Parent, err = s.sealParent(ikey, token, key); err != nil {
+		return "", "", err
+	}
+
+	isk := s.storeKey(itoken)
+	if err = s.put(isk, &r); err != nil {
+		return "", "", err
+	}
+
+	if err = s.addImpersonation(s.storeKey(token), pr, isk); err != nil {
+		s.store.Delete(isk)
+		return "", "", err
+	}
+
+	return
+}
+
+// addImpersonation will keep the store key of an impersonation session with the parent session psk,
+// dropping the ones that are already gone
+func (s *Sessions) addImpersonation(psk string, pr *Record, isk string) (err error) {
+	for {
+		if pr.Successor != "" {
+			// the rotated pair ends with its successor, which holds the impersonations
+			psk = pr.Successor
+			if pr, err = s.store.Get(psk); err != nil {
+				return
+			}
+		}
+
+		gone := make(map[string]bool)
+		for _, k := range pr.Impersonations {
+			if _, err := s.store.Get(k); err == ErrSessionDoesNotExist {
+				gone[k] = true
+			}
+		}
+
+		if err = s.update(psk, func(r *Record) error {
+			if r.Successor != "" {
+				return ErrSessionRotated
+			}
+
+			keys := make([]string, 0, len(r.Impersonations)+1)
+			for _, k := range r.Impersonations {
+				if !gone[k] {
+					keys = append(keys, k)
+				}
+			}
+
+			r.Impersonations = append(keys, isk)
+			return nil
+		}); err != ErrSessionRotated {
+			return
+		}
+
+		// rotated in the meantime
+		if pr, err = s.store.Get(psk); err != nil {
+			return
+		}
+	}
+}
+
+// update will change the session of key with fn atomically if the store is an Updater,
+// otherwise the updates of this instance are serialized
+func (s *Sessions) update(key string, fn func(r *Record) error) (err error) {
+	if u, ok := s.store.(Updater); ok {
+		return u.Update(key, fn)
+	}
+
+	s.umux.Lock()
+	defer s.umux.Unlock()
+
+	var r *Record
+	if r, err = s.store.Get(key); err != nil {
+		return
+	}
+
+	if err = fn(r); err != nil {
+		return
+	}
+
+	return s.store.Put(key, r)
+}
+
+// remove will delete the session of key along with the impersonation sessions started from it, every removal
+// of a session goes through it except for the rotated pairs which hand their impersonations to their successor
+func (s *Sessions) remove(key string, r *Record) (err error) {
+	if err = s.deleteImpersonations(r); err != nil {
+		return
+	}
+
+	return s.store.Delete(key)
+}
+
+// deleteImpersonations will remove the impersonation sessions started from r, rotated pairs are skipped as
+// their impersonations belong to their successor
+func (s *Sessions) deleteImpersonations(r *Record) (err error) {
+	if r.Successor != "" {
+		return
+	}
+
+	for _, k := range r.Impersonations {
+		if err = s.store.Delete(k); err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+	}
+
+	return nil
+}
+
+// EndImpersonation will remove an impersonation session and return the token/key pair of the impersonator's own session
+func (s *Sessions) EndImpersonation(token, key string) (ptoken, pkey string, err error) {
+	var (
+		sk string
+		r  *Record
+	)
+
+	if sk, r, err = s.lookup(token, key); err != nil {
+		return
+	}
+
+	if r.Impersonator == "" {
+		err = ErrNotImpersonating
+		return
+	}
+
+	if r.Successor != "" {
+		err = ErrSessionRotated
+		return
+	}
+
+	if ptoken, pkey, err = s.openParent(key, r.Parent); err != nil {
+		return
+	}
+
+	if err = s.remove(sk, r); err != nil {
+		return
+	}
+
+	var pr *Record
+	if _, pr, err = s.lookup(ptoken, pkey); err != nil {
+		return "", "", err
+	}
+
+	if !pr.alive(time.Now().Unix(), &s.opts) {
+		// the impersonator's session ended in the meantime
+		return "", "", ErrSessionDoesNotExist
+	}
+
+	return
+}
+
+// Rotate will issue a new token/key pair for the session of token/key, for example after a login, a change of
+// privileges or at an interval. The old pair keeps working for Options.RotationGrace, for the requests in flight
+func (s *Sessions) Rotate(token, key string) (ntoken, nkey string, err error) {
+	var (
+		sk string
+		r  *Record
+	)
+
+	if sk, r, err = s.lookup(token, key); err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	if !r.alive(now, &s.opts) {
+		return "", "", ErrSessionDoesNotExist
+	}
+
+	if r.Successor != "" {
+		return "", "", ErrSessionRotated
+	}
+
+	nr := r.dup()
+	nr.LastAction = now
+	nr.IssuedAt = now
+
+	ntoken = s.g.New().String()
+	nkey = s.g.New().String()
+	nr.KeyHash = s.keyHash(nkey)
+
+	if r.Parent != "" {
+		// the parent pair is sealed with the key of the session
+		var ptoken, pkey string
+		if ptoken, pkey, err = s.openParent(key, r.Parent); err != nil {
+			return "", "", err
+		}
+
+		if nr.Parent, err = s.sealParent(nkey, ptoken, pkey); err != nil {
+			return "", "", err
+		}
+	}
+
+	nsk := s.storeKey(ntoken)
+	if err = s.put(nsk, nr); err != nil {
+		return "", "", err
+	}
+
+	grace := int64(s.opts.RotationGrace / time.Second)
+	if grace <= 0 {
+		// the impersonations were copied to the successor
+		err = s.store.Delete(sk)
+	} else {
+		r.Successor = nsk
+		r.GraceUntil = now + grace
+		err = s.put(sk, r)
+	}
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return
+}
+
+// Delete will remove the session of a token/key pair, for example on logout.
+// Deleting a rotated pair also removes its successor
+func (s *Sessions) Delete(token, key string) (err error) {
 	var (
-		ss *session
-		ok bool
+		sk string
+		r  *Record
 	)
 
-	s.mux.Read(func() {
+	if sk, r, err = s.lookup(token, key); err != nil {
+		return
+	}
+
+	if r.Successor != "" {
+		var nr *Record
+		if nr, err = s.store.Get(r.Successor); err == nil {
+			err = s.remove(r.Successor, nr)
+		}
+
+		if err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+	}
+
+	return s.remove(sk, r)
+}
+
+// DeleteByUUID will remove all the sessions of a uuid and return how many were removed
+func (s *Sessions) DeleteByUUID(uuid string) (n int, err error) {
+	return s.deleteKeys(uuid, func(string) bool { return true })
+}
+
+// DeleteAllExcept will remove all the sessions of a uuid except the one of token, for logging out other devices.
+// It returns how many sessions were removed
+func (s *Sessions) DeleteAllExcept(uuid, token string) (n int, err error) {
+	keep := s.storeKey(token)
+	return s.deleteKeys(uuid, func(sk string) bool { return sk != keep })
+}
+
+// deleteKeys will remove the sessions of a uuid for which fn returns true
+func (s *Sessions) deleteKeys(uuid string, fn func(mk string) bool) (n int, err error) {
+	if err = s.isClosed(); err != nil {
+		return
+	}
+
+	var keys []string
+	if keys, err = s.store.Keys(uuid); err != nil {
+		return
+	}
+
+	for _, mk := range keys {
+		if !fn(mk) {
+			continue
+		}
+
+		var r *Record
+		if r, err = s.store.Get(mk); err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
+			return
+		}
 
-		if ss, ok = s.m[getMapKey(token, key)]; !ok {
-			err = ErrSessionDoesNotExist
+		if err = s.remove(mk, r); err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
 			return
 		}
 
-		// Set uuid as session uuid
-		uuid = ss.UUID
-		// Set last action for session
-		ss.setAction()
+		n++
+	}
+
+	return n, nil
+}
+
+// ListByUUID will return the active sessions of a uuid, oldest first
+func (s *Sessions) ListByUUID(uuid string) (out []Session, err error) {
+	var rs []*Record
+	if _, rs, err = s.active(uuid); err != nil {
+		return
+	}
+
+	out = make([]Session, 0, len(rs))
+	for _, r := range rs {
+		out = append(out, r.public(s.maxLifetime()))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
 	})
 
 	return
 }
 
-func (s *Sessions) load() (err error) {
-	var f *os.File
-	if f, err = os.Open(filepath.Join(s.dir, snapshotName)); err != nil {
+// active will return the active sessions of a uuid and their store keys, the rotated pairs are left out as they
+// are represented by their successors
+func (s *Sessions) active(uuid string) (keys []string, rs []*Record, err error) {
+	if err = s.isClosed(); err != nil {
+		return
+	}
+
+	var all []string
+	if all, err = s.store.Keys(uuid); err != nil {
 		return
 	}
-	defer f.Close()
 
-	return json.NewDecoder(f).Decode(&s.m)
+	now := time.Now().Unix()
+	for _, mk := range all {
+		r, err := s.store.Get(mk)
+		if err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if r.Successor == "" && r.alive(now, &s.opts) {
+			keys = append(keys, mk)
+			rs = append(rs, r)
+		}
+	}
+
+	return
 }
 
-func (s *Sessions) snapshot() (err error) {
-	if err = os.MkdirAll(s.dir, 0744); err != nil {
+// DeleteByID will remove a session of a uuid by its ID, for revoking the sessions returned by ListByUUID
+func (s *Sessions) DeleteByID(uuid, id string) (err error) {
+	if err = s.isClosed(); err != nil {
 		return
 	}
 
-	var f *os.File
-	if f, err = os.Create(filepath.Join(s.dir, snapshotName)); err != nil {
+	var keys []string
+	if keys, err = s.store.Keys(uuid); err != nil {
 		return
 	}
-	defer f.Close()
 
-	return json.NewEncoder(f).Encode(s.m)
+	// the rotated pairs of the session share its ID
+	found := false
+	for _, mk := range keys {
+		r, err := s.store.Get(mk)
+		if err == ErrSessionDoesNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if r.ID != id {
+			continue
+		}
+
+		if err = s.remove(mk, r); err != nil && err != ErrSessionDoesNotExist {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return ErrSessionDoesNotExist
+	}
+
+	return nil
 }
 
-// Close will close an instance of Sessions
+// Close will stop the purge loop and close the store, the store is closed even when it returns an error.
+// If the parent context closed the instance, the first call returns the error of closing the store
 func (s *Sessions) Close() (err error) {
 	if !s.closed.Set(true) {
+		<-s.done
+		if s.ctxClosed.Set(false) {
+			return s.closeErr
+		}
 		return errors.ErrIsClosed
 	}
 
-	return s.snapshot()
-}
-
-func getMapKey(token, key string) (mapkey string) {
-	return token + "::" + key
+	s.cancel()
+	<-s.done
+	return s.store.Close()
 }
@@ -1,8 +1,15 @@
 package sessions
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
 )
 
 const (
@@ -11,13 +18,32 @@ const (
 	testUser3 = "TEST_USER_3"
 )
 
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// mustNew will return a new instance of sessions or fail the test
+func mustNew(tb testing.TB, dir string, opts Options) *Sessions {
+	s, err := NewWithOptions(dir, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return s
+}
+
+// stop will stop the purge loop of s without closing its store
+func stop(s *Sessions) {
+	s.closed.Set(true)
+	s.cancel()
+	<-s.done
+}
+
 func TestSessions(t *testing.T) {
 	var (
 		s   *Sessions
 		err error
 	)
 
-	s = New("./test_data")
+	s = mustNew(t, "./test_data", Options{})
 	defer os.RemoveAll("./test_data")
 
 	var tu1t, tu1k string
@@ -53,7 +79,7 @@ func TestSessions(t *testing.T) {
 	}
 
 	// Re-open sessions from snapshot
-	s = New("./test_data")
+	s = mustNew(t, "./test_data", Options{})
 
 	// Make sure the values still match
 
@@ -75,3 +101,443 @@ func TestSessions(t *testing.T) {
 		t.Fatalf("invalid user match, expected %s and received %s", testUser3, mu)
 	}
 }
+
+func TestImpersonate(t *testing.T) {
+	s := mustNew(t, "./test_data_impersonate", Options{})
+	defer os.RemoveAll("./test_data_impersonate")
+	defer s.Close()
+
+	at, ak := s.New(testUser1)
+
+	it, ik, err := s.Impersonate(at, ak, testUser2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ss Session
+	if ss, err = s.GetSession(it, ik); err != nil {
+		t.Fatal(err)
+	} else if ss.UUID != testUser2 || ss.Impersonator != testUser1 {
+		t.Fatalf("invalid session: %+v", ss)
+	}
+
+	if _, _, err = s.Impersonate(it, ik, testUser3, time.Hour); err != ErrNestedImpersonation {
+		t.Fatalf("expected ErrNestedImpersonation, got %v", err)
+	}
+
+	if _, _, err = s.EndImpersonation(at, ak); err != ErrNotImpersonating {
+		t.Fatalf("expected ErrNotImpersonating, got %v", err)
+	}
+
+	var pt, pk string
+	if pt, pk, err = s.EndImpersonation(it, ik); err != nil {
+		t.Fatal(err)
+	} else if pt != at || pk != ak {
+		t.Fatal("invalid parent session")
+	}
+
+	// expired impersonation sessions are rejected
+	if it, ik, err = s.Impersonate(at, ak, testUser2, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(it, ik); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	// the impersonation sessions end with the impersonator's session, also after it was rotated
+	if it, ik, err = s.Impersonate(at, ak, testUser2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if at, ak, err = s.Rotate(at, ak); err != nil {
+		t.Fatal(err)
+	}
+
+	it2, ik2, err := s.Impersonate(at, ak, testUser3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(at, ak); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pair := range [][2]string{{it, ik}, {it2, ik2}} {
+		if _, err = s.Get(pair[0], pair[1]); err != ErrSessionDoesNotExist {
+			t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+		}
+	}
+
+	at, ak = s.New(testUser1)
+	if it, ik, err = s.Impersonate(at, ak, testUser2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.DeleteByUUID(testUser1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(it, ik); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	// concurrent impersonations are all kept with the parent
+	at, ak = s.New(testUser1)
+
+	var (
+		wg    sync.WaitGroup
+		pairs = make([][2]string, 8)
+	)
+
+	for i := range pairs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			it, ik, err := s.Impersonate(at, ak, testUser2, time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+			pairs[i] = [2]string{it, ik}
+		}(i)
+	}
+	wg.Wait()
+
+	// the purge collects the idle parent along with its impersonations
+	now := time.Now().Unix()
+	r, err := s.store.Get(s.storeKey(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.LastAction = now - 100
+	if err = s.store.Put(s.storeKey(at), r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Purge(now - 50); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pair := range pairs {
+		if _, err = s.Get(pair[0], pair[1]); err != ErrSessionDoesNotExist {
+			t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := mustNew(t, "./test_data_delete", Options{})
+	defer os.RemoveAll("./test_data_delete")
+	defer s.Close()
+
+	t1, k1 := s.New(testUser1)
+	t2, k2 := s.New(testUser1)
+	t3, k3 := s.New(testUser1)
+	t4, k4 := s.New(testUser2)
+
+	if err := s.Delete(t1, k1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(t1, k1); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if n, err := s.DeleteAllExcept(testUser1, t2); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted session, got %d %v", n, err)
+	}
+
+	if _, err := s.Get(t3, k3); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if _, err := s.Get(t2, k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.DeleteByUUID(testUser1); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted session, got %d %v", n, err)
+	}
+
+	if _, err := s.Get(t2, k2); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if _, err := s.Get(t4, k4); err != nil {
+		t.Fatal(err)
+	}
+
+	uuids := make(map[string]struct{})
+	for _, sh := range s.store.(*MemoryStore).shards {
+		for uuid := range sh.u {
+			uuids[uuid] = struct{}{}
+		}
+	}
+
+	if len(uuids) != 1 {
+		t.Fatalf("unexpected reverse index: %v", uuids)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	s := mustNew(t, "./test_data_timeouts", Options{IdleTimeout: time.Hour, MaxLifetime: 2 * time.Second})
+	defer os.RemoveAll("./test_data_timeouts")
+	defer s.Close()
+
+	t1, k1 := s.New(testUser1)
+	t2, k2, _ := s.NewWithOptions(testUser1, SessionOptions{MaxLifetime: time.Hour})
+	t3, k3, _ := s.NewWithOptions(testUser2, SessionOptions{IdleTimeout: time.Second})
+
+	ss, err := s.GetSession(t1, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ss.Expires.IsZero() || time.Until(ss.Expires) > 2*time.Second {
+		t.Fatalf("unexpected expiry: %v", ss.Expires)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// activity doesn't extend the max lifetime
+	if _, err = s.Get(t1, k1); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if _, err = s.Get(t2, k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(t3, k3); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	s.Purge(0)
+	if n := s.store.(*MemoryStore).Len(); n != 1 {
+		t.Fatalf("expected 1 session after the purge, got %d", n)
+	}
+}
+
+func TestListByUUID(t *testing.T) {
+	s := mustNew(t, "./test_data_list", Options{})
+	defer os.RemoveAll("./test_data_list")
+	defer func() { s.Close() }()
+
+	t1, k1, _ := s.NewWithOptions(testUser1, SessionOptions{IP: "10.0.0.1", UserAgent: "phone", Values: map[string]string{"device": "a"}})
+	t2, k2, _ := s.NewWithOptions(testUser1, SessionOptions{IP: "10.0.0.2", UserAgent: "laptop"})
+	s.New(testUser2)
+
+	list, err := s.ListByUUID(testUser1)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", list)
+	}
+
+	ss, err := s.GetSession(t1, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ss.ID == "" || ss.ID == t1 || ss.IP != "10.0.0.1" || ss.UserAgent != "phone" || ss.Values["device"] != "a" || ss.Created.IsZero() {
+		t.Fatalf("unexpected session: %+v", ss)
+	}
+
+	if err = s.DeleteByID(testUser2, ss.ID); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if err = s.DeleteByID(testUser1, ss.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, _ = s.ListByUUID(testUser1); len(list) != 1 || list[0].UserAgent != "laptop" {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the IDs and metadata survive snapshots
+	s = mustNew(t, "./test_data_list", Options{})
+	if ss, err = s.GetSession(t2, k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ss.ID != list[0].ID || ss.IP != "10.0.0.2" {
+		t.Fatalf("unexpected session: %+v", ss)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s := mustNew(t, "./test_data_rotate", Options{})
+	defer os.RemoveAll("./test_data_rotate")
+	defer s.Close()
+
+	t1, k1, _ := s.NewWithOptions(testUser1, SessionOptions{UserAgent: "phone"})
+
+	nt1, nk1, err := s.Rotate(t1, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := s.GetSession(nt1, nk1)
+	if err != nil || ss.UUID != testUser1 || ss.UserAgent != "phone" || ss.Issued.Before(ss.Created) {
+		t.Fatalf("unexpected session: %+v %v", ss, err)
+	}
+
+	// the old pair works during the grace window
+	if uuid, err := s.Get(t1, k1); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if _, _, err = s.Rotate(t1, k1); err != ErrSessionRotated {
+		t.Fatalf("expected ErrSessionRotated, got %v", err)
+	}
+
+	if list, _ := s.ListByUUID(testUser1); len(list) != 1 || list[0].ID != ss.ID {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+
+	// and not after it
+	r, err := s.store.Get(s.storeKey(t1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.GraceUntil = time.Now().Unix()
+	if err = s.store.Put(s.storeKey(t1), r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(t1, k1); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	// logging out ends the old pair too
+	t2, k2 := s.New(testUser2)
+	nt2, nk2, err := s.Rotate(t2, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(nt2, nk2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(t2, k2); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	// the parent of an impersonation session follows the rotation
+	it, ik, err := s.Impersonate(nt1, nk1, testUser3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nit, nik, err := s.Rotate(it, ik)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = s.EndImpersonation(it, ik); err != ErrSessionRotated {
+		t.Fatalf("expected ErrSessionRotated, got %v", err)
+	}
+
+	if pt, pk, err := s.EndImpersonation(nit, nik); err != nil || pt != nt1 || pk != nk1 {
+		t.Fatalf("unexpected parent: %q %q %v", pt, pk, err)
+	}
+
+	// without a grace window the old pair ends right away
+	s2 := mustNew(t, "", Options{RotationGrace: -1})
+	defer s2.Close()
+
+	t3, k3 := s2.New(testUser3)
+	if _, _, err = s2.Rotate(t3, k3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s2.Get(t3, k3); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	const dir = "./test_data_lifecycle"
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewWithContext(ctx, dir, Options{PurgeInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, key := s.New(testUser1)
+
+	// the purge loop stops with the context instead of after its interval
+	cancel()
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("the purge loop didn't stop")
+	}
+
+	if _, err = s.Get(token, key); err != errors.ErrIsClosed {
+		t.Fatalf("expected ErrIsClosed, got %v", err)
+	}
+
+	if _, _, err = s.NewWithOptions(testUser1, SessionOptions{}); err != errors.ErrIsClosed {
+		t.Fatalf("expected ErrIsClosed, got %v", err)
+	}
+
+	// the first Close returns the error of closing the store
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != errors.ErrIsClosed {
+		t.Fatalf("expected ErrIsClosed, got %v", err)
+	}
+
+	// the store was closed, so its sessions were saved
+	if s, err = New(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if uuid, err := s.Get(token, key); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.ListByUUID(testUser1); err != errors.ErrIsClosed {
+		t.Fatalf("expected ErrIsClosed, got %v", err)
+	}
+
+	// a corrupt snapshot is an error instead of an empty instance
+	if err = ioutil.WriteFile(filepath.Join(dir, snapshotName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(dir); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	if s, err = NewWithContext(ctx, "", Options{Store: closeErrStore{NewMemoryStore()}, Secret: testSecret}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err = s.Close(); err != errCloseStore {
+		t.Fatalf("expected errCloseStore, got %v", err)
+	}
+}
+
+const errCloseStore = errors.Error("close failed")
+
+type closeErrStore struct{ Store }
+
+func (closeErrStore) Close() error { return errCloseStore }
@@ -0,0 +1,510 @@
+package sessions
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/uuid"
+)
+
+// Store is a session storage backend, it has to be safe for concurrent use.
+// Get must return ErrSessionDoesNotExist for missing keys, and Touch must not recreate a deleted session
+type Store interface {
+	Get(key string) (*Record, error)
+	Put(key string, r *Record) error
+	// Touch will set the last action of a session
+	Touch(key string, lastAction int64) error
+	Delete(key string) error
+	// Keys will return the keys of the sessions of a uuid
+	Keys(uuid string) ([]string, error)
+	ForEach(fn func(key string, r *Record) error) error
+	Close() error
+}
+
+// Updater is implemented by the stores which can change a session atomically, fn is called with a copy of the
+// session and it is replaced with the copy unless fn returns an error. fn must not change the UUID
+type Updater interface {
+	Update(key string, fn func(r *Record) error) error
+}
+
+// optionsSetter is implemented by the stores which need the options of Sessions, they are set by NewWithContext
+type optionsSetter interface {
+	setOptions(o Options)
+}
+
+// FileOptions are the settings of the persistence of a file store, see NewFileStore
+type FileOptions struct {
+	// SyncPolicy sets when the session log is fsynced, see SyncPolicy
+	SyncPolicy SyncPolicy
+	// SyncInterval is the interval between fsyncs with SyncBatch, defaults to DefaultSyncInterval
+	SyncInterval time.Duration
+	// CompactThreshold is the number of log records after which the log is compacted into the snapshot,
+	// defaults to DefaultCompactThreshold
+	CompactThreshold int
+}
+
+// DefaultShards is the number of shards of a MemoryStore, each one has its own lock
+const DefaultShards = 32
+
+// NewMemoryStore will return a Store which keeps the sessions in memory only
+func NewMemoryStore() *MemoryStore {
+	return newMemoryStore(DefaultShards)
+}
+
+func newMemoryStore(shards int) *MemoryStore {
+	s := &MemoryStore{shards: make([]*shard, shards)}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			m: make(map[string]*Record),
+			u: make(map[string]map[string]struct{}),
+		}
+	}
+
+	return s
+}
+
+// NewFileStore will return a memory Store which persists the sessions to dir, every change is appended to a log
+// which is compacted into a snapshot every opts.CompactThreshold records and on Close
+func NewFileStore(dir string, opts FileOptions) (ms *MemoryStore, err error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	if opts.CompactThreshold <= 0 {
+		opts.CompactThreshold = DefaultCompactThreshold
+	}
+
+	s := NewMemoryStore()
+	s.dir = dir
+	s.threshold = opts.CompactThreshold
+
+	if err = s.load(opts); err != nil {
+		return
+	}
+
+	ms = s
+	return
+}
+
+// MemoryStore is a Store which keeps the sessions in memory, optionally persisted to a directory.
+// The sessions are spread over shards by key so requests for different sessions rarely wait on each other
+type MemoryStore struct {
+	shards []*shard
+
+	dir       string
+	threshold int
+	// w is the log of the changes since the snapshot, it is nil while loading and for memory only stores.
+	// It is set while holding the locks of all the shards
+	w *wal
+}
+
+// shard is a part of the sessions of a MemoryStore
+type shard struct {
+	mux sync.RWMutex
+
+	m map[string]*Record
+	// u is the map keys of the sessions of each uuid within the shard
+	u map[string]map[string]struct{}
+}
+
+// shard will return the shard of a key, by the FNV-1a hash of the key
+func (s *MemoryStore) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// lockAll will lock every shard for writing, always in the same order
+func (s *MemoryStore) lockAll() {
+	for _, sh := range s.shards {
+		sh.mux.Lock()
+	}
+}
+
+func (s *MemoryStore) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mux.Unlock()
+	}
+}
+
+// Get will return a copy of a session
+func (s *MemoryStore) Get(key string) (r *Record, err error) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	rr, ok := sh.m[key]
+	if !ok {
+		return nil, ErrSessionDoesNotExist
+	}
+
+	return rr.dup(), nil
+}
+
+// Put will create or replace a session
+func (s *MemoryStore) Put(key string, r *Record) (err error) {
+	r = r.dup()
+
+	sh := s.shard(key)
+	sh.mux.Lock()
+	if err = s.w.create(key, r); err != nil {
+		sh.mux.Unlock()
+		return
+	}
+
+	sh.remove(key)
+	sh.put(key, r)
+	full := s.full()
+	sh.mux.Unlock()
+
+	if full {
+		err = s.compactIfNeeded()
+	}
+
+	return
+}
+
+// Touch will set the last action of a session
+func (s *MemoryStore) Touch(key string, lastAction int64) (err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	r, ok := sh.m[key]
+	if !ok {
+		sh.mux.Unlock()
+		return ErrSessionDoesNotExist
+	}
+
+	if err = s.w.touch(key, lastAction); err != nil {
+		sh.mux.Unlock()
+		return
+	}
+
+	r.LastAction = lastAction
+	full := s.full()
+	sh.mux.Unlock()
+
+	if full {
+		err = s.compactIfNeeded()
+	}
+
+	return
+}
+
+// Update will change a session atomically, see Updater
+func (s *MemoryStore) Update(key string, fn func(r *Record) error) (err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	rr, ok := sh.m[key]
+	if !ok {
+		sh.mux.Unlock()
+		return ErrSessionDoesNotExist
+	}
+
+	r := rr.dup()
+	if err = fn(r); err != nil {
+		sh.mux.Unlock()
+		return
+	}
+
+	if err = s.w.create(key, r); err != nil {
+		sh.mux.Unlock()
+		return
+	}
+
+	sh.m[key] = r
+	full := s.full()
+	sh.mux.Unlock()
+
+	if full {
+		err = s.compactIfNeeded()
+	}
+
+	return
+}
+
+// Delete will remove a session
+func (s *MemoryStore) Delete(key string) (err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	if _, ok := sh.m[key]; !ok {
+		sh.mux.Unlock()
+		return ErrSessionDoesNotExist
+	}
+
+	if err = s.w.delete(key); err != nil {
+		sh.mux.Unlock()
+		return
+	}
+
+	sh.remove(key)
+	full := s.full()
+	sh.mux.Unlock()
+
+	if full {
+		err = s.compactIfNeeded()
+	}
+
+	return
+}
+
+// Keys will return the keys of the sessions of a uuid
+func (s *MemoryStore) Keys(uuid string) (keys []string, err error) {
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for key := range sh.u[uuid] {
+			keys = append(keys, key)
+		}
+		sh.mux.RUnlock()
+	}
+
+	return
+}
+
+// ForEach will call fn with a copy of every session, fn can't call the other methods of the store.
+// Only one shard is locked at a time, so the sessions changed meanwhile may or may not be seen
+func (s *MemoryStore) ForEach(fn func(key string, r *Record) error) (err error) {
+	for _, sh := range s.shards {
+		if err = sh.forEach(fn); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Len will return the number of sessions
+func (s *MemoryStore) Len() (n int) {
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		n += len(sh.m)
+		sh.mux.RUnlock()
+	}
+
+	return
+}
+
+// Compact will write a snapshot of the sessions and empty the log, it is a no-op for memory only stores
+func (s *MemoryStore) Compact() (err error) {
+	s.lockAll()
+	defer s.unlockAll()
+	return s.compact()
+}
+
+// Close will compact and close the log of a file store
+func (s *MemoryStore) Close() (err error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.w == nil {
+		return
+	}
+
+	err = s.compact()
+	if cerr := s.w.close(); err == nil {
+		err = cerr
+	}
+
+	s.w = nil
+	return
+}
+
+func (sh *shard) forEach(fn func(key string, r *Record) error) (err error) {
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	for key, r := range sh.m {
+		if err = fn(key, r.dup()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// put will add a session, the caller must hold the write lock of the shard
+func (sh *shard) put(key string, r *Record) {
+	sh.m[key] = r
+
+	keys, ok := sh.u[r.UUID]
+	if !ok {
+		keys = make(map[string]struct{})
+		sh.u[r.UUID] = keys
+	}
+
+	keys[key] = struct{}{}
+}
+
+// remove will remove a session, the caller must hold the write lock of the shard
+func (sh *shard) remove(key string) {
+	r, ok := sh.m[key]
+	if !ok {
+		return
+	}
+
+	delete(sh.m, key)
+
+	keys := sh.u[r.UUID]
+	if delete(keys, key); len(keys) == 0 {
+		delete(sh.u, r.UUID)
+	}
+}
+
+// load will load the snapshot and replay the log on top of it
+func (s *MemoryStore) load(opts FileOptions) (err error) {
+	if err = s.loadSnapshot(); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	var w *wal
+	if w, err = openWAL(s.dir, opts.SyncPolicy, opts.SyncInterval); err != nil {
+		return
+	}
+
+	if err = w.replay(s.apply); err != nil {
+		w.close()
+		return
+	}
+
+	s.w = w
+	return
+}
+
+func (s *MemoryStore) loadSnapshot() (err error) {
+	var f *os.File
+	if f, err = os.Open(filepath.Join(s.dir, snapshotName)); err != nil {
+		return
+	}
+	defer f.Close()
+
+	m := make(map[string]*Record)
+	if err = json.NewDecoder(f).Decode(&m); err != nil {
+		return
+	}
+
+	g := uuid.NewGen()
+	for key, r := range m {
+		// snapshots from before CreatedAt and ID existed
+		if r.CreatedAt == 0 {
+			r.CreatedAt = r.LastAction
+		}
+
+		if r.ID == "" {
+			r.ID = g.New().String()
+		}
+
+		s.shard(key).put(key, r)
+	}
+
+	return
+}
+
+// apply will apply a log record while loading
+func (s *MemoryStore) apply(rec *walRecord) {
+	sh := s.shard(rec.Key)
+	switch rec.Op {
+	case walCreate:
+		if rec.S != nil {
+			sh.remove(rec.Key)
+			sh.put(rec.Key, rec.S)
+		}
+
+	case walTouch:
+		if r, ok := sh.m[rec.Key]; ok {
+			r.LastAction = rec.TS
+		}
+
+	case walDelete:
+		sh.remove(rec.Key)
+	}
+}
+
+// full will return if the log reached the compaction threshold, the caller must hold the lock of a shard
+func (s *MemoryStore) full() bool {
+	return s.w != nil && s.w.len() >= s.threshold
+}
+
+// compactIfNeeded will compact the log once it reaches the threshold, the caller must not hold any lock
+func (s *MemoryStore) compactIfNeeded() error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	// another change may have compacted it first
+	if !s.full() {
+		return nil
+	}
+
+	return s.compact()
+}
+
+// compact will write a snapshot and empty the log, the caller must hold the locks of all the shards
+func (s *MemoryStore) compact() (err error) {
+	if s.w == nil {
+		return
+	}
+
+	if err = s.snapshot(); err != nil {
+		return
+	}
+
+	return s.w.reset()
+}
+
+// snapshot will atomically replace the snapshot, the caller must hold the locks of all the shards
+func (s *MemoryStore) snapshot() (err error) {
+	if err = os.MkdirAll(s.dir, 0744); err != nil {
+		return
+	}
+
+	var (
+		name = filepath.Join(s.dir, snapshotName)
+		tmp  = name + ".tmp"
+		f    *os.File
+	)
+
+	if f, err = os.Create(tmp); err != nil {
+		return
+	}
+
+	m := make(map[string]*Record)
+	for _, sh := range s.shards {
+		for key, r := range sh.m {
+			m[key] = r
+		}
+	}
+
+	if err = json.NewEncoder(f).Encode(m); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if err = os.Rename(tmp, name); err != nil {
+		return
+	}
+
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) (err error) {
+	var d *os.File
+	if d, err = os.Open(dir); err != nil {
+		return
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
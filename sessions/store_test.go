@@ -0,0 +1,255 @@
+package sessions
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	defer os.RemoveAll("./test_data_stores")
+
+	srv := newFakeRedis(t)
+	defer srv.Close()
+
+	stores := map[string]func() (Store, error){
+		"memory": func() (Store, error) { return NewMemoryStore(), nil },
+		"file":   func() (Store, error) { return NewFileStore("./test_data_stores/file", FileOptions{}) },
+		"turtle": func() (Store, error) { return NewTurtleStore("./test_data_stores/turtle") },
+		"redis":  func() (Store, error) { return NewRedisStore(srv.Addr(), RedisOptions{}) },
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			st, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testStore(t, st)
+		})
+	}
+}
+
+// testStore checks the behavior Sessions relies on
+func testStore(t *testing.T, st Store) {
+	s := mustNew(t, "", Options{Store: st, Secret: testSecret})
+	defer s.Close()
+
+	t1, k1 := s.New(testUser1)
+	t2, k2 := s.New(testUser1)
+	s.New(testUser2)
+
+	if uuid, err := s.Get(t1, k1); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if _, err := s.Get(t1, k2); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	future := time.Now().Unix() + 100
+	if err := st.Touch(s.storeKey(t2), future); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := st.Get(s.storeKey(t2)); err != nil || r.LastAction != future {
+		t.Fatalf("unexpected record: %+v %v", r, err)
+	}
+
+	// the idle session is purged, the purge loop may get to it first
+	if err := st.Touch(s.storeKey(t1), 42); err != nil && err != ErrSessionDoesNotExist {
+		t.Fatal(err)
+	}
+
+	if err := s.Purge(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(t1, k1); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if keys, err := st.Keys(testUser1); err != nil || len(keys) != 1 || keys[0] != s.storeKey(t2) {
+		t.Fatalf("unexpected keys: %v %v", keys, err)
+	}
+
+	if err := st.Touch(s.storeKey(t1), time.Now().Unix()); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if n, err := s.DeleteByUUID(testUser1); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted session, got %d %v", n, err)
+	}
+
+	var n int
+	if err := st.ForEach(func(key string, r *Record) error {
+		if r.UUID != testUser2 {
+			t.Fatalf("unexpected record: %s %+v", key, r)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 session, got %d", n)
+	}
+}
+
+// BenchmarkGet compares a single lock, like the store had before it was sharded, to the sharded store
+func BenchmarkGet(b *testing.B) {
+	stores := []struct {
+		name string
+		new  func() Store
+	}{
+		{"global", func() Store { return newGlobalStore() }},
+		{"shards-1", func() Store { return newMemoryStore(1) }},
+		{"shards-" + strconv.Itoa(DefaultShards), func() Store { return newMemoryStore(DefaultShards) }},
+	}
+
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			s := mustNew(b, "", Options{Store: st.new(), Secret: testSecret})
+			defer s.Close()
+
+			type session struct{ uuid, token, key string }
+			ss := make([]session, 10000)
+			for i := range ss {
+				uuid := "user-" + strconv.Itoa(i%1000)
+				token, key := s.New(uuid)
+				ss[i] = session{uuid, token, key}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					se := ss[(i*7919)%len(ss)]
+					if i%10 == 0 {
+						// a tenth of the requests are logins and logouts
+						t, k := s.New(se.uuid)
+						s.Delete(t, k)
+						continue
+					}
+
+					if _, err := s.Get(se.token, se.key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// globalStore is the memory store as it was before it was sharded, every request waits on one lock
+type globalStore struct {
+	mux sync.RWMutex
+
+	m map[string]*Record
+	u map[string]map[string]struct{}
+}
+
+func newGlobalStore() *globalStore {
+	return &globalStore{
+		m: make(map[string]*Record),
+		u: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *globalStore) Get(key string) (r *Record, err error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	rr, ok := s.m[key]
+	if !ok {
+		return nil, ErrSessionDoesNotExist
+	}
+
+	return rr.dup(), nil
+}
+
+func (s *globalStore) Put(key string, r *Record) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	r = r.dup()
+	s.remove(key)
+	s.m[key] = r
+
+	keys, ok := s.u[r.UUID]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.u[r.UUID] = keys
+	}
+
+	keys[key] = struct{}{}
+	return
+}
+
+func (s *globalStore) Touch(key string, lastAction int64) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	r, ok := s.m[key]
+	if !ok {
+		return ErrSessionDoesNotExist
+	}
+
+	r.LastAction = lastAction
+	return
+}
+
+func (s *globalStore) Delete(key string) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.m[key]; !ok {
+		return ErrSessionDoesNotExist
+	}
+
+	s.remove(key)
+	return
+}
+
+func (s *globalStore) Keys(uuid string) (keys []string, err error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	for key := range s.u[uuid] {
+		keys = append(keys, key)
+	}
+
+	return
+}
+
+func (s *globalStore) ForEach(fn func(key string, r *Record) error) (err error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	for key, r := range s.m {
+		if err = fn(key, r.dup()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *globalStore) Close() error { return nil }
+
+func (s *globalStore) remove(key string) {
+	r, ok := s.m[key]
+	if !ok {
+		return
+	}
+
+	delete(s.m, key)
+
+	keys := s.u[r.UUID]
+	if delete(keys, key); len(keys) == 0 {
+		delete(s.u, r.UUID)
+	}
+}
@@ -0,0 +1,314 @@
+package sessions
+
+import (
+	"encoding/json"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	recordsBkt = "sessions"
+	uuidsBkt   = "uuids"
+)
+
+// NewTurtleStore will return a Store backed by a turtleDB in dir
+func NewTurtleStore(dir string) (ts *TurtleStore, err error) {
+	fm := turtleDB.NewFuncsMap(marshalRecord, unmarshalRecord)
+	fm.Put(uuidsBkt, marshalKeys, unmarshalKeys)
+
+	var t TurtleStore
+	if t.db, err = turtleDB.New("sessions", dir, fm); err != nil {
+		return
+	}
+
+	if err = t.db.Update(func(txn turtleDB.Txn) (err error) {
+		if _, err = txn.Create(recordsBkt); err != nil {
+			return
+		}
+
+		_, err = txn.Create(uuidsBkt)
+		return
+	}); err != nil {
+		t.db.Close()
+		return
+	}
+
+	ts = &t
+	return
+}
+
+// TurtleStore is a Store backed by turtleDB
+type TurtleStore struct {
+	db *turtleDB.Turtle
+}
+
+func getRecord(txn turtleDB.Txn, key string) (r Record, err error) {
+	var (
+		bkt turtleDB.Bucket
+		val turtleDB.Value
+		ok  bool
+	)
+
+	if bkt, err = txn.Get(recordsBkt); err != nil {
+		return
+	}
+
+	if val, err = bkt.Get(key); err != nil {
+		if err == turtleDB.ErrKeyDoesNotExist {
+			err = ErrSessionDoesNotExist
+		}
+		return
+	}
+
+	if r, ok = val.(Record); !ok {
+		err = turtleDB.ErrInvalidType
+	}
+
+	return
+}
+
+func getKeys(txn turtleDB.Txn, uuid string) (keys []string, err error) {
+	var (
+		bkt turtleDB.Bucket
+		val turtleDB.Value
+	)
+
+	if bkt, err = txn.Get(uuidsBkt); err != nil {
+		return
+	}
+
+	if val, err = bkt.Get(uuid); err != nil {
+		if err == turtleDB.ErrKeyDoesNotExist {
+			err = nil
+		}
+		return
+	}
+
+	var ok bool
+	if keys, ok = val.([]string); !ok {
+		err = turtleDB.ErrInvalidType
+	}
+
+	return
+}
+
+// putKeys will set the keys of a uuid, the slice is copied so the stored value isn't shared
+func putKeys(txn turtleDB.Txn, uuid string, keys []string) (err error) {
+	var bkt turtleDB.Bucket
+	if bkt, err = txn.Get(uuidsBkt); err != nil {
+		return
+	}
+
+	if len(keys) == 0 {
+		if err = bkt.Delete(uuid); err == turtleDB.ErrKeyDoesNotExist {
+			err = nil
+		}
+		return
+	}
+
+	return bkt.Put(uuid, append([]string(nil), keys...))
+}
+
+// Get will return a session
+func (t *TurtleStore) Get(key string) (r *Record, err error) {
+	err = t.db.Read(func(txn turtleDB.Txn) (err error) {
+		var rr Record
+		if rr, err = getRecord(txn, key); err != nil {
+			return
+		}
+
+		r = rr.dup()
+		return
+	})
+
+	return
+}
+
+// Put will create or replace a session
+func (t *TurtleStore) Put(key string, r *Record) (err error) {
+	return t.db.Update(func(txn turtleDB.Txn) (err error) {
+		if err = t.delete(txn, key); err != nil && err != ErrSessionDoesNotExist {
+			return
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(recordsBkt); err != nil {
+			return
+		}
+
+		if err = bkt.Put(key, *r.dup()); err != nil {
+			return
+		}
+
+		var keys []string
+		if keys, err = getKeys(txn, r.UUID); err != nil {
+			return
+		}
+
+		return putKeys(txn, r.UUID, append(keys[:len(keys):len(keys)], key))
+	})
+}
+
+// Touch will set the last action of a session
+func (t *TurtleStore) Touch(key string, lastAction int64) (err error) {
+	return t.db.Update(func(txn turtleDB.Txn) (err error) {
+		var r Record
+		if r, err = getRecord(txn, key); err != nil {
+			return
+		}
+
+		r.LastAction = lastAction
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(recordsBkt); err != nil {
+			return
+		}
+
+		return bkt.Put(key, r)
+	})
+}
+
+// Update will change a session atomically, see Updater
+func (t *TurtleStore) Update(key string, fn func(r *Record) error) (err error) {
+	return t.db.Update(func(txn turtleDB.Txn) (err error) {
+		var r Record
+		if r, err = getRecord(txn, key); err != nil {
+			return
+		}
+
+		nr := r.dup()
+		if err = fn(nr); err != nil {
+			return
+		}
+
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(recordsBkt); err != nil {
+			return
+		}
+
+		return bkt.Put(key, *nr)
+	})
+}
+
+// Delete will remove a session
+func (t *TurtleStore) Delete(key string) (err error) {
+	return t.db.Update(func(txn turtleDB.Txn) error {
+		return t.delete(txn, key)
+	})
+}
+
+func (t *TurtleStore) delete(txn turtleDB.Txn, key string) (err error) {
+	var r Record
+	if r, err = getRecord(txn, key); err != nil {
+		return
+	}
+
+	var bkt turtleDB.Bucket
+	if bkt, err = txn.Get(recordsBkt); err != nil {
+		return
+	}
+
+	if err = bkt.Delete(key); err != nil {
+		return
+	}
+
+	var keys []string
+	if keys, err = getKeys(txn, r.UUID); err != nil {
+		return
+	}
+
+	out := keys[:0:0]
+	for _, k := range keys {
+		if k != key {
+			out = append(out, k)
+		}
+	}
+
+	return putKeys(txn, r.UUID, out)
+}
+
+// Keys will return the keys of the sessions of a uuid
+func (t *TurtleStore) Keys(uuid string) (keys []string, err error) {
+	err = t.db.Read(func(txn turtleDB.Txn) (err error) {
+		var ks []string
+		if ks, err = getKeys(txn, uuid); err != nil {
+			return
+		}
+
+		keys = append(keys, ks...)
+		return
+	})
+
+	return
+}
+
+// ForEach will call fn with every session, fn can't call the other methods of the store
+func (t *TurtleStore) ForEach(fn func(key string, r *Record) error) (err error) {
+	return t.db.Read(func(txn turtleDB.Txn) (err error) {
+		var bkt turtleDB.Bucket
+		if bkt, err = txn.Get(recordsBkt); err != nil {
+			return
+		}
+
+		return bkt.ForEach(func(key string, val turtleDB.Value) error {
+			r, ok := val.(Record)
+			if !ok {
+				return turtleDB.ErrInvalidType
+			}
+			return fn(key, r.dup())
+		})
+	})
+}
+
+// Close will close the database
+func (t *TurtleStore) Close() (err error) {
+	return t.db.Close()
+}
+
+func marshalRecord(val turtleDB.Value) (b []byte, err error) {
+	var (
+		r  Record
+		ok bool
+	)
+
+	if r, ok = val.(Record); !ok {
+		err = turtleDB.ErrInvalidType
+		return
+	}
+
+	return json.Marshal(r)
+}
+
+func unmarshalRecord(b []byte) (val turtleDB.Value, err error) {
+	var r Record
+	if err = json.Unmarshal(b, &r); err != nil {
+		return
+	}
+
+	val = r
+	return
+}
+
+func marshalKeys(val turtleDB.Value) (b []byte, err error) {
+	var (
+		keys []string
+		ok   bool
+	)
+
+	if keys, ok = val.([]string); !ok {
+		err = turtleDB.ErrInvalidType
+		return
+	}
+
+	return json.Marshal(keys)
+}
+
+func unmarshalKeys(b []byte) (val turtleDB.Value, err error) {
+	var keys []string
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return
+	}
+
+	val = keys
+	return
+}
@@ -0,0 +1,228 @@
+package sessions
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walName = "sessions.wal"
+
+	// DefaultCompactThreshold is the default number of log records after which the log is compacted into the snapshot
+	DefaultCompactThreshold = 10000
+	// DefaultSyncInterval is the default interval between fsyncs of the log with SyncBatch
+	DefaultSyncInterval = time.Second
+)
+
+// SyncPolicy sets when the session log is fsynced
+type SyncPolicy uint8
+
+const (
+	// SyncBatch fsyncs the log every Options.SyncInterval, a crash of the machine can lose the last interval
+	SyncBatch SyncPolicy = iota
+	// SyncAlways fsyncs the log after every record
+	SyncAlways
+	// SyncNever leaves flushing the log to the OS
+	SyncNever
+)
+
+const (
+	walCreate = "c"
+	walTouch  = "t"
+	walDelete = "d"
+)
+
+// walRecord is a line of the session log
+type walRecord struct {
+	Op  string  `json:"op"`
+	Key string  `json:"k"`
+	S   *Record `json:"s,omitempty"`
+	TS  int64   `json:"ts,omitempty"`
+}
+
+// wal is the append-only log of the changes since the last snapshot.
+// Its records are appended while holding the lock of the shard of their key, so the records of a key are in order,
+// and it is compacted while holding the locks of all the shards. Its mutex orders the shards and the periodic fsyncs
+type wal struct {
+	mux sync.Mutex
+
+	f      *os.File
+	policy SyncPolicy
+	n      int
+	dirty  bool
+	// err is the error of a failed write or fsync, see append
+	err error
+
+	done chan struct{}
+}
+
+func openWAL(dir string, policy SyncPolicy, interval time.Duration) (w *wal, err error) {
+	if err = os.MkdirAll(dir, 0744); err != nil {
+		return
+	}
+
+	var f *os.File
+	if f, err = os.OpenFile(filepath.Join(dir, walName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return
+	}
+
+	w = &wal{f: f, policy: policy, done: make(chan struct{})}
+	if policy == SyncBatch {
+		go w.syncLoop(interval)
+	}
+
+	return
+}
+
+// replay will call fn with every record of the log, a torn last line left by a crash is truncated.
+// A corrupt record before it is an ErrCorruptLog error rather than dropping the records after it
+func (w *wal) replay(fn func(rec *walRecord)) (err error) {
+	if _, err = w.f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	var (
+		r    = bufio.NewReader(w.f)
+		good int64
+	)
+
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if rerr == io.EOF {
+			// a partial line without its newline is a torn write
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+
+		var rec walRecord
+		if json.Unmarshal(bytes.TrimSpace(line), &rec) != nil || rec.Key == "" {
+			return fmt.Errorf("%w: at offset %d", ErrCorruptLog, good)
+		}
+
+		fn(&rec)
+		good += int64(len(line))
+		w.n++
+	}
+
+	return w.f.Truncate(good)
+}
+
+func (w *wal) create(mk string, ss *Record) error {
+	return w.append(&walRecord{Op: walCreate, Key: mk, S: ss})
+}
+
+func (w *wal) touch(mk string, ts int64) error {
+	return w.append(&walRecord{Op: walTouch, Key: mk, TS: ts})
+}
+
+func (w *wal) delete(mk string) error {
+	return w.append(&walRecord{Op: walDelete, Key: mk})
+}
+
+// append will write a record, and fsync it with SyncAlways. The first error is kept and returned by every append
+// until the next compaction, since a failed write can leave a partial line behind
+func (w *wal) append(rec *walRecord) (err error) {
+	if w == nil {
+		return
+	}
+
+	var b []byte
+	if b, err = json.Marshal(rec); err != nil {
+		return
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err = w.f.Write(append(b, '\n')); err != nil {
+		w.err = err
+		return
+	}
+
+	w.n++
+	if w.policy != SyncAlways {
+		w.dirty = true
+		return
+	}
+
+	if err = w.f.Sync(); err != nil {
+		w.err = err
+	}
+
+	return
+}
+
+// len will return the number of records of the log
+func (w *wal) len() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.n
+}
+
+// reset will empty the log once its records are in the snapshot, which clears the error of a failed append
+func (w *wal) reset() (err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if err = w.f.Truncate(0); err != nil {
+		return
+	}
+
+	w.n = 0
+	w.dirty = false
+	if err = w.f.Sync(); err == nil {
+		w.err = nil
+	}
+
+	return
+}
+
+func (w *wal) syncLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			w.mux.Lock()
+			if w.dirty && w.err == nil {
+				// returned by the next append
+				w.err = w.f.Sync()
+				w.dirty = false
+			}
+			w.mux.Unlock()
+
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *wal) close() (err error) {
+	close(w.done)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if err = w.f.Sync(); err == nil {
+		err = w.err
+	}
+
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return
+}
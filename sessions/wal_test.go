@@ -0,0 +1,135 @@
+package sessions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crash will stop s without compacting the log, like a crash of the process would
+func crash(s *Sessions) {
+	stop(s)
+
+	ms := s.store.(*MemoryStore)
+	ms.lockAll()
+	defer ms.unlockAll()
+
+	ms.w.close()
+	ms.w = nil
+}
+
+func TestWAL(t *testing.T) {
+	const dir = "./test_data_wal"
+	defer os.RemoveAll(dir)
+
+	s := mustNew(t, dir, Options{File: FileOptions{SyncPolicy: SyncAlways}})
+	t1, k1 := s.New(testUser1)
+	t2, k2 := s.New(testUser2)
+	t3, k3 := s.New(testUser3)
+
+	if err := s.Delete(t2, k2); err != nil {
+		t.Fatal(err)
+	}
+
+	crash(s)
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no snapshot, got %v", err)
+	}
+
+	// a torn write at the end of the log
+	f, err := os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteString(`{"op":"d","k":"` + s.storeKey(t1)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s = mustNew(t, dir, Options{File: FileOptions{SyncPolicy: SyncAlways}})
+
+	if uuid, err := s.Get(t1, k1); err != nil || uuid != testUser1 {
+		t.Fatalf("unexpected session: %q %v", uuid, err)
+	}
+
+	if _, err = s.Get(t2, k2); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	ms := s.store.(*MemoryStore)
+	if err = ms.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ms.w.len(); n != 0 {
+		t.Fatalf("expected an empty log, got %d records", n)
+	}
+
+	if err = s.Delete(t3, k3); err != nil {
+		t.Fatal(err)
+	}
+
+	crash(s)
+
+	// the snapshot plus the log
+	s = mustNew(t, dir, Options{})
+	defer s.Close()
+
+	if _, err = s.Get(t1, k1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(t3, k3); err != ErrSessionDoesNotExist {
+		t.Fatalf("expected ErrSessionDoesNotExist, got %v", err)
+	}
+
+	if list, _ := s.ListByUUID(testUser3); len(list) != 0 {
+		t.Fatal("the deleted session is still indexed")
+	}
+}
+
+func TestWALErrors(t *testing.T) {
+	const dir = "./test_data_wal_errors"
+	defer os.RemoveAll(dir)
+
+	s := mustNew(t, dir, Options{File: FileOptions{SyncPolicy: SyncAlways}})
+	t1, _ := s.New(testUser1)
+	crash(s)
+
+	// a corrupt record followed by good ones isn't a torn write
+	f, err := os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteString("garbage\n" + `{"op":"d","k":"` + s.storeKey(t1) + "\"}\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err = NewWithOptions(dir, Options{}); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected ErrCorruptLog, got %v", err)
+	}
+
+	if err = os.Remove(filepath.Join(dir, walName)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write is returned by the store operation
+	s = mustNew(t, dir, Options{File: FileOptions{SyncPolicy: SyncAlways}})
+	defer stop(s)
+
+	ms := s.store.(*MemoryStore)
+	ms.w.f.Close()
+
+	if _, _, err = s.NewWithOptions(testUser2, SessionOptions{}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if n := ms.Len(); n != 0 {
+		t.Fatalf("expected the failed session to be left out, got %d sessions", n)
+	}
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+const (
+	// DefaultDeletionGrace is the grace period of StatusPendingDeletion when StatusOptions.Until isn't set.
+	DefaultDeletionGrace = 30 * 24 * time.Hour
+
+	// MaxStatusHistory is the number of entries kept in User.StatusHistory, older entries are dropped.
+	MaxStatusHistory = 50
+)
+
+// StatusChange is an entry of User.StatusHistory.
+type StatusChange struct {
+	From Status `json:"from"`
+	To   Status `json:"to"`
+
+	Reason string `json:"reason,omitempty"`
+	// Actor is the ID of the user that made the change, it is empty for system changes.
+	Actor string `json:"actor,omitempty"`
+
+	TS int64 `json:"ts"`
+	// Until is the end of a suspension or of a deletion grace period in unix seconds.
+	Until int64 `json:"until,omitempty"`
+
+	// Override is set if the change bypassed the allowed transitions.
+	Override bool `json:"override,omitempty"`
+}
+
+// StatusOptions are the options used by Auth.SetStatus.
+type StatusOptions struct {
+	Reason string
+
+	// Until is the end of a suspension, a zero Until suspends indefinitely,
+	// or when a pending deletion becomes final, it defaults to DefaultDeletionGrace from now.
+	Until time.Time
+
+	// Override allows transitions that aren't allowed by CanTransition, like StatusBanned to StatusActive.
+	Override bool
+}
+
+var transitions = map[Status][]Status{
+	StatusInactive:  {StatusActive, StatusSuspended, StatusBanned, StatusPendingDeletion, StatusDeleted},
+	StatusActive:    {StatusInactive, StatusSuspended, StatusBanned, StatusPendingDeletion, StatusDeleted},
+	StatusSuspended: {StatusActive, StatusInactive, StatusBanned, StatusPendingDeletion, StatusDeleted},
+	StatusBanned:    {StatusPendingDeletion, StatusDeleted},
+
+	// a pending deletion can also be cancelled, see CanTransition.
+	StatusPendingDeletion: {StatusDeleted},
+}
+
+// CanTransition returns true if u can go from its current status to status to without an override.
+// A pending deletion can only be cancelled by going back to the status the user had before it,
+// StatusDeleted is final.
+func CanTransition(u *User, to Status) bool {
+	from := u.Status
+	if from == to {
+		return true
+	}
+
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	if from == StatusPendingDeletion {
+		return u.previousStatus() == to
+	}
+
+	return false
+}
+
+// previousStatus returns the status the user had before the current one, or StatusActive if it isn't known.
+// The entries that set the current status again, like a suspension being extended, are skipped.
+func (u *User) previousStatus() Status {
+	for i := len(u.StatusHistory) - 1; i >= 0 && u.StatusHistory[i].To == u.Status; i-- {
+		if from := u.StatusHistory[i].From; from != u.Status {
+			return from
+		}
+	}
+	return StatusActive
+}
+
+// StatusExpired returns true if the user's suspension or deletion grace period ended.
+func (u *User) StatusExpired() bool {
+	switch u.Status {
+	case StatusSuspended, StatusPendingDeletion:
+		return u.StatusUntil > 0 && u.StatusUntil <= time.Now().Unix()
+	}
+	return false
+}
+
+// SetStatus changes the status of a user, recording the change in User.StatusHistory.
+// It returns ErrBadTransition if the change isn't allowed by CanTransition and opts.Override isn't set.
+// Setting StatusSuspended or StatusPendingDeletion again replaces the end of the suspension or grace period
+// and records the new reason, setting any other status again is a no-op.
+func (a *Auth) SetStatus(id string, s Status, opts StatusOptions) error {
+	return a.editUser(auditInfo{}, id, "", statusFn(s, opts))
+}
+
+// Suspend suspends a user until the specified time, a zero until suspends indefinitely.
+// The user is reactivated by Auth.ExpireStatuses or on their next Login after until.
+func (a *Auth) Suspend(id string, until time.Time, reason string) error {
+	return a.SetStatus(id, StatusSuspended, StatusOptions{Reason: reason, Until: until})
+}
+
+// ScheduleDeletion marks a user as pending deletion, they become StatusDeleted after the grace period.
+// It can be cancelled with SetStatus and the user's previous status.
+func (a *Auth) ScheduleDeletion(id string, grace time.Duration, reason string) error {
+	return a.SetStatus(id, StatusPendingDeletion, StatusOptions{Reason: reason, Until: time.Now().Add(grace)})
+}
+
+// ExpireStatuses reactivates the users whose suspension ended and sets the users whose deletion grace
+// period ended to StatusDeleted, it returns the number of changed users. It should be called periodically.
+func (a *Auth) ExpireStatuses() (n int, err error) {
+	var olds []User
+	if err = a.read(func(tx turtleDB.Txn) error {
+		usersB, err := tx.Get("users")
+		if err != nil {
+			return err
+		}
+
+		var ids []string
+		if err = usersB.ForEach(func(id string, val turtleDB.Value) error {
+			if u, ok := val.(User); ok && u.StatusExpired() {
+				ids = append(ids, id)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			u, err := GetUserByIDTx(tx, id)
+			if err != nil {
+				return err
+			}
+			olds = append(olds, u)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	// the before hooks run outside the db lock
+	us := make([]*User, len(olds))
+	for i := range olds {
+		if us[i], err = a.prepareEdit(auditInfo{}, &olds[i], expireStatus); err != nil {
+			return 0, err
+		}
+	}
+
+	var evs []HookEvent
+	if err = a.update(func(tx turtleDB.Txn) error {
+		for i := range olds {
+			uevs, err := a.commitEdit(tx, auditInfo{}, &olds[i], us[i])
+			switch err {
+			case nil:
+			case errUserChanged, ErrUserNotFound, turtleDB.ErrKeyDoesNotExist:
+				// changed since it was read, it is left to the next call
+				continue
+			default:
+				return err
+			}
+
+			evs = append(evs, uevs...)
+			n++
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	a.outbox.notify()
+	a.hooks.runAfter(evs)
+	return
+}
+
+// SetStatus is Auth.SetStatus performed by the actor.
+func (ac *Actor) SetStatus(id string, s Status, opts StatusOptions) error {
+	return ac.a.editUser(ac.ai, id, "", statusFn(s, opts))
+}
+
+func statusFn(s Status, opts StatusOptions) func(u *User) error {
+	return func(u *User) error {
+		if u.Status == s && s != StatusSuspended && s != StatusPendingDeletion {
+			return nil
+		}
+
+		sc := StatusChange{To: s, Reason: opts.Reason, Override: opts.Override}
+		switch {
+		case s == StatusPendingDeletion && opts.Until.IsZero():
+			sc.Until = time.Now().Add(DefaultDeletionGrace).Unix()
+		case !opts.Until.IsZero():
+			sc.Until = opts.Until.Unix()
+		}
+
+		u.Status = s
+		u.StatusHistory = append(u.StatusHistory, sc)
+		return nil
+	}
+}
+
+// expireStatus ends an expired suspension or finalizes an expired pending deletion.
+func expireStatus(u *User) error {
+	if !u.StatusExpired() {
+		// changed since it was checked
+		return nil
+	}
+
+	sc := StatusChange{To: StatusDeleted, Reason: "deletion grace period ended"}
+	if u.Status == StatusSuspended {
+		sc.To, sc.Reason = u.previousStatus(), "suspension ended"
+	}
+
+	u.Status = sc.To
+	u.StatusHistory = append(u.StatusHistory, sc)
+	return nil
+}
+
+// statusChanged returns true if the edit from old to u changed the status or set it again, see Auth.SetStatus.
+func statusChanged(old, u *User) bool {
+	if old.Status != u.Status {
+		return true
+	}
+
+	no, nu := len(old.StatusHistory), len(u.StatusHistory)
+	return nu > 0 && (no == 0 || old.StatusHistory[no-1] != u.StatusHistory[nu-1])
+}
+
+// applyStatusChange is called by prepareEdit after the edit func, it records the status change in the
+// history if the edit func didn't and checks that the transition is allowed.
+// An entry added by the edit func without changing the status sets the status again, see Auth.SetStatus.
+func applyStatusChange(ai auditInfo, old, u *User) error {
+	n := len(u.StatusHistory)
+	added := n == len(old.StatusHistory)+1 && u.StatusHistory[n-1].To == u.Status
+	if old.Status == u.Status && !added {
+		return nil
+	}
+
+	if !added {
+		u.StatusHistory = append(u.StatusHistory, StatusChange{To: u.Status})
+		n++
+	}
+
+	sc := &u.StatusHistory[n-1]
+	sc.From, sc.TS = old.Status, time.Now().Unix()
+	if sc.Actor == "" {
+		sc.Actor = ai.actor
+	}
+
+	if !sc.Override && !CanTransition(old, u.Status) {
+		return ErrBadTransition
+	}
+
+	switch u.Status {
+	case StatusSuspended, StatusPendingDeletion:
+		u.StatusUntil = sc.Until
+	default:
+		u.StatusUntil, sc.Until = 0, 0
+	}
+
+	if n > MaxStatusHistory {
+		u.StatusHistory = append([]StatusChange(nil), u.StatusHistory[n-MaxStatusHistory:]...)
+	}
+
+	return nil
+}
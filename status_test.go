@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatusLifecycle(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewWithOptions(tmpPath, Options{Audit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	id, err := a.CreateUser("gozer", "destructor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.SetStatus(id, StatusActive, StatusOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := a.Actor("1", nil)
+	if err = admin.SetStatus(id, StatusSuspended, StatusOptions{Reason: "spam", Until: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := a.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Status != StatusSuspended || !u.StatusExpired() {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	if sc := u.StatusHistory[len(u.StatusHistory)-1]; sc.From != StatusActive || sc.Reason != "spam" || sc.Actor != "1" {
+		t.Fatalf("unexpected status change: %+v", sc)
+	}
+
+	// the suspension ended, so login reactivates the user.
+	if u, err = a.Login("gozer", "destructor"); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Status != StatusActive || u.StatusUntil != 0 {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	if err = a.Suspend(id, time.Time{}, "abuse"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Login("gozer", "destructor"); err != ErrBadStatus {
+		t.Fatalf("expected ErrBadStatus, got %v", err)
+	}
+
+	if n, err := a.ExpireStatuses(); err != nil || n != 0 {
+		t.Fatalf("an indefinite suspension expired: %d %v", n, err)
+	}
+
+	// suspending again replaces the end of the suspension
+	if err = a.Suspend(id, time.Now().Add(-time.Second), "appeal"); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if sc := u.StatusHistory[len(u.StatusHistory)-1]; u.StatusUntil == 0 || sc.From != StatusSuspended || sc.Reason != "appeal" {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	// the suspension ends with the status from before the first one
+	if n, err := a.ExpireStatuses(); err != nil || n != 1 {
+		t.Fatalf("expected 1 user, got %d %v", n, err)
+	}
+
+	if u, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Status != StatusActive {
+		t.Fatalf("expected StatusActive, got %v", u.Status)
+	}
+
+	if err = a.SetStatus(id, StatusBanned, StatusOptions{Reason: "more abuse"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.SetStatus(id, StatusActive, StatusOptions{}); err != ErrBadTransition {
+		t.Fatalf("expected ErrBadTransition, got %v", err)
+	}
+
+	if err = a.EditUserByID(id, func(u *User) error {
+		u.Status = StatusActive
+		return nil
+	}); err != ErrBadTransition {
+		t.Fatalf("expected ErrBadTransition, got %v", err)
+	}
+
+	if err = a.SetStatus(id, StatusActive, StatusOptions{Reason: "appeal", Override: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.ScheduleDeletion(id, -time.Second, "requested"); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling goes back to the previous status only.
+	if err = a.SetStatus(id, StatusInactive, StatusOptions{}); err != ErrBadTransition {
+		t.Fatalf("expected ErrBadTransition, got %v", err)
+	}
+
+	n, err := a.ExpireStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+
+	if u, err = a.GetUserByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Status != StatusDeleted {
+		t.Fatalf("expected StatusDeleted, got %v", u.Status)
+	}
+
+	if err = a.SetStatus(id, StatusActive, StatusOptions{}); err != ErrBadTransition {
+		t.Fatalf("expected ErrBadTransition, got %v", err)
+	}
+
+	exp := []Status{
+		StatusActive, StatusSuspended, StatusActive, StatusSuspended, StatusSuspended, StatusActive,
+		StatusBanned, StatusActive, StatusPendingDeletion, StatusDeleted,
+	}
+	if len(u.StatusHistory) != len(exp) {
+		t.Fatalf("unexpected history: %+v", u.StatusHistory)
+	}
+
+	for i, sc := range u.StatusHistory {
+		if sc.To != exp[i] {
+			t.Fatalf("unexpected history: %+v", u.StatusHistory)
+		}
+	}
+
+	if !u.StatusHistory[7].Override {
+		t.Fatalf("the override wasn't recorded: %+v", u.StatusHistory[7])
+	}
+
+	evs, err := a.AuditLog(AuditFilter{UserID: id, Types: []AuditType{AuditStatus}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evs) != len(exp) || evs[1].Meta["reason"] != "spam" {
+		t.Fatalf("unexpected audit events: %+v", evs)
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"io"
+	"strings"
+
+	"github.com/PathDNA/turtleDB"
+)
+
+// Tenant is a namespace of users within an Auth store, usernames are unique per tenant and each tenant has
+// its own ID counter. The IDs of a tenant's users are prefixed with "<tenant id>:".
+// The default tenant has an empty ID and is the one used by Auth's own methods.
+type Tenant struct {
+	a  *Auth
+	id string
+}
+
+// Tenant returns the tenant with the specified id, tenants don't have to be created.
+// Tenant IDs can't contain ':' or NUL characters.
+func (a *Auth) Tenant(id string) (*Tenant, error) {
+	if strings.ContainsAny(id, ":\x00") {
+		return nil, ErrInvalidTenant
+	}
+
+	return &Tenant{a, id}, nil
+}
+
+// ID returns the ID of the tenant.
+func (t *Tenant) ID() string { return t.id }
+
+// CreateUser is Auth.CreateUser within the tenant.
+func (t *Tenant) CreateUser(username, password string) (id string, err error) {
+	return t.a.createUser(auditInfo{}, t.id, "", username, password)
+}
+
+// CreateUserWithID is Auth.CreateUserWithID within the tenant, id is the tenant's part of the ID.
+func (t *Tenant) CreateUserWithID(id string, username, password string) (uid string, err error) {
+	return t.a.createUser(auditInfo{}, t.id, id, username, password)
+}
+
+// GetUserByID returns a User of the tenant by their ID.
+func (t *Tenant) GetUserByID(id string) (u User, err error) {
+	if !t.owns(id) {
+		return User{}, ErrUserNotFound
+	}
+
+	return t.a.GetUserByID(id)
+}
+
+// GetUserByName returns a User of the tenant by their UserName.
+func (t *Tenant) GetUserByName(username string) (u User, err error) {
+	return t.a.getUserByName(t.id, username)
+}
+
+// EditUserByID edits a user of the tenant by their ID, returning an error will cancel the edit.
+func (t *Tenant) EditUserByID(id string, fn func(u *User) error) error {
+	if !t.owns(id) {
+		return ErrUserNotFound
+	}
+
+	return t.a.editUser(auditInfo{}, id, "", fn)
+}
+
+// EditUserByName edits a user of the tenant by their username, returning an error will cancel the edit.
+func (t *Tenant) EditUserByName(username string, fn func(u *User) error) error {
+	if err := validUsername(username); err != nil {
+		return err
+	}
+
+	return t.a.editUser(auditInfo{}, "", loginKey(t.id, username), fn)
+}
+
+// DeleteUserByID is Auth.DeleteUserByID within the tenant.
+func (t *Tenant) DeleteUserByID(id string) error {
+	if !t.owns(id) {
+		return ErrUserNotFound
+	}
+
+	return t.a.deleteUser(auditInfo{}, id)
+}
+
+// Login is Auth.Login within the tenant.
+func (t *Tenant) Login(username, password string) (User, error) {
+	return t.a.login(auditInfo{}, t.id, username, password)
+}
+
+// ChangePassword is Auth.ChangePassword within the tenant.
+func (t *Tenant) ChangePassword(username, oldPassword, newPassword string) error {
+	return t.a.changePassword(t.id, username, oldPassword, newPassword)
+}
+
+// ForEach will iterate through each of the users of the tenant.
+func (t *Tenant) ForEach(fn func(User) error) error {
+	return t.a.ForEach(func(u User) error {
+		if u.TenantID != t.id {
+			return nil
+		}
+		return fn(u)
+	})
+}
+
+// Export is Auth.Export limited to the users of the tenant, their logins and the tenant's ID counter.
+// The output can be imported in another store with Auth.Import.
+func (t *Tenant) Export(w io.Writer) error {
+	counter := tenantCounter(t.id)
+	return t.a.export(w, nil, func(bucket, key string, val turtleDB.Value) bool {
+		switch bucket {
+		case "users":
+			u, ok := val.(User)
+			return ok && u.TenantID == t.id
+		case "logins":
+			id, _ := val.(string)
+			return t.owns(id)
+		case "index":
+			return key == counter
+		}
+		return false
+	})
+}
+
+// owns returns true if the user id belongs to the tenant.
+func (t *Tenant) owns(id string) bool {
+	tenant, _ := splitUserID(id)
+	return tenant == t.id
+}
+
+// validUsername returns ErrInvalidUsername if username has a NUL, which would let a lookup in the default tenant
+// reach the logins of the other tenants, see loginKey.
+func validUsername(username string) error {
+	if strings.IndexByte(username, 0) != -1 {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+// loginKey returns the key of a username in the logins bucket, the default tenant's keys are plain usernames.
+func loginKey(tenant, username string) string {
+	if tenant == "" {
+		return username
+	}
+	return tenant + "\x00" + username
+}
+
+// tenantCounter returns the key of a tenant's ID counter in the index bucket.
+func tenantCounter(tenant string) string {
+	if tenant == "" {
+		return "users"
+	}
+	return "users:" + tenant
+}
+
+// tenantUserID returns the ID of the n-th user of a tenant.
+func tenantUserID(tenant, n string) string {
+	if tenant == "" {
+		return n
+	}
+	return tenant + ":" + n
+}
+
+// splitUserID is the reverse of tenantUserID.
+func splitUserID(id string) (tenant, n string) {
+	if i := strings.LastIndexByte(id, ':'); i != -1 {
+		return id[:i], id[i+1:]
+	}
+	return "", id
+}
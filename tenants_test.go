@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := New(filepath.Join(tmpPath, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if _, err = a.Tenant("a:b"); err != ErrInvalidTenant {
+		t.Fatalf("expected ErrInvalidTenant, got %v", err)
+	}
+
+	acme, _ := a.Tenant("acme")
+	globex, _ := a.Tenant("globex")
+
+	did, err := a.CreateUser("bob", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aid, err := acme.CreateUser("bob", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gid, err := globex.CreateUser("bob", "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if did != "1" || aid != "acme:1" || gid != "globex:1" {
+		t.Fatalf("unexpected ids: %s %s %s", did, aid, gid)
+	}
+
+	if _, err = acme.CreateUser("bob", "again"); err != ErrUserExists {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+
+	if _, err = globex.GetUserByID(aid); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if u, err := acme.Login("bob", "acme"); err != nil || u.ID != aid || u.TenantID != "acme" {
+		t.Fatalf("unexpected login: %+v %v", u, err)
+	}
+
+	if _, err = acme.Login("bob", "globex"); err != ErrInvalidLogin {
+		t.Fatalf("expected ErrInvalidLogin, got %v", err)
+	}
+
+	if u, err := a.Login("bob", "default"); err != nil || u.ID != did {
+		t.Fatalf("unexpected login: %+v %v", u, err)
+	}
+
+	// the default tenant's lookups don't reach the logins of the other tenants
+	if _, err = a.Login("acme\x00bob", "acme"); err != ErrInvalidLogin {
+		t.Fatalf("expected ErrInvalidLogin, got %v", err)
+	}
+
+	if _, err = a.GetUserByName("acme\x00bob"); err != ErrInvalidUsername {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+
+	if err = a.ChangePassword("acme\x00bob", "acme", "pwned"); err != ErrInvalidLogin {
+		t.Fatalf("expected ErrInvalidLogin, got %v", err)
+	}
+
+	if err = a.EditUserByName("acme\x00bob", func(*User) error { return nil }); err != ErrInvalidUsername {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+
+	if err = acme.EditUserByName("bob", func(u *User) error {
+		u.Username = "robert"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = acme.GetUserByName("bob"); err == nil {
+		t.Fatal("the old username is still indexed")
+	}
+
+	if err = acme.EditUserByID(aid, func(u *User) error {
+		u.TenantID = "globex"
+		return nil
+	}); err != ErrTenantChange {
+		t.Fatalf("expected ErrTenantChange, got %v", err)
+	}
+
+	if _, err = acme.CreateUser("alice", "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err = acme.ForEach(func(u User) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Fatalf("expected 2 users, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	if err = acme.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(filepath.Join(tmpPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	st, err := b.Import(&buf, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 users and the counter
+	if st.Imported != 3 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	bacme, _ := b.Tenant("acme")
+	if u, err := bacme.Login("robert", "acme"); err != nil || u.ID != aid {
+		t.Fatalf("unexpected login: %+v %v", u, err)
+	}
+
+	if _, err = b.GetUserByName("bob"); err == nil {
+		t.Fatal("the default tenant was exported")
+	}
+
+	if id, err := bacme.CreateUser("carol", "acme"); err != nil || id != "acme:3" {
+		t.Fatalf("unexpected id: %s %v", id, err)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import "encoding/json"
+
+// TypedUser is a User with a concrete Profile type.
+type TypedUser[P any] struct {
+	User
+
+	Profile *P `json:"profile,omitempty"`
+}
+
+// Untyped returns the plain User with the Profile field set to the typed profile.
+func (tu *TypedUser[P]) Untyped() (u User) {
+	u = tu.User
+	u.Profile = nil
+	if tu.Profile != nil {
+		u.Profile = tu.Profile
+	}
+	return
+}
+
+// TypedAuth wraps Auth so users are returned with a concrete Profile type.
+// The untyped Auth methods are still available through the embedded *Auth.
+type TypedAuth[P any] struct {
+	*Auth
+}
+
+// NewTyped returns a new TypedAuth db at the specificed path.
+func NewTyped[P any](path string) (*TypedAuth[P], error) {
+	return NewTypedEncrypted[P](path, nil, nil)
+}
+
+// NewTypedEncrypted returns a new TypedAuth db that is encrypted with the specified key/iv.
+// if key is nil, it returns a non-encrypted store.
+func NewTypedEncrypted[P any](path string, key, iv []byte) (*TypedAuth[P], error) {
+	return NewTypedWithOptions[P](path, Options{Key: key, IV: iv})
+}
+
+// NewTypedWithOptions returns a new TypedAuth db at the specified path using the provided options,
+// opts.ProfileFn is replaced with one returning *P.
+func NewTypedWithOptions[P any](path string, opts Options) (*TypedAuth[P], error) {
+	opts.ProfileFn = newTypedProfile[P]
+	a, err := NewWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TypedAuth[P]{a}, nil
+}
+
+// Typed wraps an existing Auth, it replaces the Auth's profile func so profiles are decoded as *P.
+// Profiles that were already decoded without a profile func are converted on read.
+func Typed[P any](a *Auth) *TypedAuth[P] {
+	a.NewProfileFn(newTypedProfile[P])
+	return &TypedAuth[P]{a}
+}
+
+func newTypedProfile[P any]() interface{} { return new(P) }
+
+// GetUserByID returns a TypedUser by their ID.
+func (ta *TypedAuth[P]) GetUserByID(id string) (tu TypedUser[P], err error) {
+	var u User
+	if u, err = ta.Auth.GetUserByID(id); err != nil {
+		return
+	}
+
+	return ta.typed(u)
+}
+
+// GetUserByName returns a TypedUser by their UserName.
+func (ta *TypedAuth[P]) GetUserByName(username string) (tu TypedUser[P], err error) {
+	var u User
+	if u, err = ta.Auth.GetUserByName(username); err != nil {
+		return
+	}
+
+	return ta.typed(u)
+}
+
+// EditUserByID edits a user by their ID, returning an error will cancel the edit.
+func (ta *TypedAuth[P]) EditUserByID(id string, fn func(u *TypedUser[P]) error) error {
+	return ta.Auth.EditUserByID(id, ta.editFn(fn))
+}
+
+// EditUserByName edits a user by their username, returning an error will cancel the edit.
+func (ta *TypedAuth[P]) EditUserByName(username string, fn func(u *TypedUser[P]) error) error {
+	return ta.Auth.EditUserByName(username, ta.editFn(fn))
+}
+
+// ForEach will iterate through each of the users
+func (ta *TypedAuth[P]) ForEach(fn func(TypedUser[P]) error) error {
+	return ta.Auth.ForEach(func(u User) error {
+		tu, err := ta.typed(u)
+		if err != nil {
+			return err
+		}
+
+		return fn(tu)
+	})
+}
+
+func (ta *TypedAuth[P]) editFn(fn func(u *TypedUser[P]) error) func(u *User) error {
+	return func(u *User) error {
+		tu, err := ta.typed(*u)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(&tu); err != nil {
+			return err
+		}
+
+		*u = tu.Untyped()
+		return nil
+	}
+}
+
+// typed will convert u, the encrypted fields of profiles decoded without a profile func still hold their
+// ciphertext and are decrypted first so they aren't encrypted twice on the next write.
+func (ta *TypedAuth[P]) typed(u User) (tu TypedUser[P], err error) {
+	if _, ok := u.Profile.(*P); ok || u.Profile == nil || ta.fields == nil {
+		return toTypedUser[P](u)
+	}
+
+	var b []byte
+	if b, err = ta.fields.decryptLoaded(u.ID, u.Profile, new(P)); err != nil {
+		return
+	}
+
+	var rec struct {
+		Profile *P `json:"profile"`
+	}
+
+	if err = json.Unmarshal(b, &rec); err != nil {
+		err = ErrProfileType
+		return
+	}
+
+	u.Profile = rec.Profile
+	return toTypedUser[P](u)
+}
+
+// toTypedUser will convert u with a copy of its profile, so edits which are cancelled don't reach the stored value
+func toTypedUser[P any](u User) (tu TypedUser[P], err error) {
+	if u.Profile != nil {
+		// the profile is either a *P, a P or a map[string]interface{} from a user loaded without a profile func
+		var b []byte
+		if b, err = json.Marshal(u.Profile); err != nil {
+			return
+		}
+
+		tu.Profile = new(P)
+		if err = json.Unmarshal(b, tu.Profile); err != nil {
+			err = ErrProfileType
+			return
+		}
+	}
+
+	tu.User = u
+	tu.User.Profile = nil
+	return
+}
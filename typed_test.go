@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+func TestTypedAuth(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	a, err := NewTyped[Profile](tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := a.CreateUser("gbusters", "who are you gonna call")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.EditUserByID(id, func(u *TypedUser[Profile]) error {
+		u.Status = StatusActive
+		u.Profile = &Profile{Name: "Ghost Busters", Phone: "1-800-555-2368"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen to make sure profiles are decoded as the concrete type
+	if a, err = NewTyped[Profile](tmpPath); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	tu, err := a.GetUserByName("gbusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tu.ID != id || tu.Status != StatusActive {
+		t.Fatalf("unexpected user: %+v", tu.User)
+	}
+
+	if tu.Profile == nil || tu.Profile.Phone != "1-800-555-2368" {
+		t.Fatalf("unexpected profile: %+v", tu.Profile)
+	}
+
+	// a cancelled edit doesn't leak into the stored profile
+	errCancel := errors.Error("cancel")
+	if err = a.EditUserByID(id, func(u *TypedUser[Profile]) error {
+		u.Profile.Phone = "nope"
+		return errCancel
+	}); err != errCancel {
+		t.Fatalf("expected errCancel, got %v", err)
+	}
+
+	if tu, err = a.GetUserByID(id); err != nil || tu.Profile.Phone != "1-800-555-2368" {
+		t.Fatalf("unexpected profile: %+v %v", tu.Profile, err)
+	}
+
+	u, err := a.Auth.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := u.Profile.(*Profile); !ok || p.Name != "Ghost Busters" {
+		t.Fatalf("unexpected untyped profile: %#+v", u.Profile)
+	}
+
+	if tu, err = toTypedUser[Profile](User{Profile: map[string]interface{}{"name": "Slimer"}}); err != nil {
+		t.Fatal(err)
+	} else if tu.Profile.Name != "Slimer" {
+		t.Fatalf("unexpected converted profile: %+v", tu.Profile)
+	}
+
+	if _, err = toTypedUser[Profile](User{Profile: "nope"}); err != ErrProfileType {
+		t.Fatalf("expected ErrProfileType, got %v", err)
+	}
+}
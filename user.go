@@ -17,24 +17,49 @@ const (
 	StatusActive
 	StatusInactive
 	StatusBanned
+	// StatusSuspended is temporary, see Auth.Suspend.
+	StatusSuspended
+	// StatusPendingDeletion becomes StatusDeleted after a grace period, see Auth.ScheduleDeletion.
+	StatusPendingDeletion
+	// StatusDeleted is final, the user record is kept so the username can't be reused.
+	StatusDeleted
 )
 
 // User is a system user.
 type User struct {
 	ID string `json:"id,omitempty"`
+	// TenantID is the tenant the user belongs to, it is empty for the default tenant, see Auth.Tenant.
+	TenantID string `json:"tenant,omitempty"`
 
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+	// PasswordImported means Password is a hash from an importer, which can be in a foreign format.
+	// It is replaced with a bcrypt hash on the next Login.
+	PasswordImported bool `json:"passwordImported,omitempty"`
+	// PasswordChangedTS is the time of the last password change, see PasswordPolicy.
+	PasswordChangedTS int64 `json:"passwordChanged,omitempty"`
+	// PasswordHistory holds the hashes of the previous passwords, newest first, see PasswordPolicy.
+	PasswordHistory []string `json:"passwordHistory,omitempty"`
 
 	Status Status `json:"status,omitempty"`
+	// StatusUntil is the end of a suspension or of a deletion grace period in unix seconds.
+	StatusUntil int64 `json:"statusUntil,omitempty"`
+	// StatusHistory is the list of status changes, oldest first, see MaxStatusHistory.
+	StatusHistory []StatusChange `json:"statusHistory,omitempty"`
 
 	CreatedTS     int64 `json:"created,omitempty"`
 	LastUpdatedTS int64 `json:"lastUpdated,omitempty"`
+	// ExpiresTS is when the account expires, Login returns ErrAccountExpired after that. Zero means never.
+	ExpiresTS int64 `json:"expires,omitempty"`
 
 	Profile interface{} `json:"profile,omitempty"`
+
+	// SchemaVersion is the version of the stored record, see Migrations.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
 }
 
 // UpdatePassword checks if the password is hashed, if not it will hash it and assign the hashed password.
+// Anything but a bcrypt hash is treated as a plain-text password.
 func (u *User) UpdatePassword() error {
 	if u.Password == "" {
 		return ErrNoPassword
@@ -47,6 +72,7 @@ func (u *User) UpdatePassword() error {
 	p, err := HashPassword(u.Password)
 	if err == nil {
 		u.Password = p
+		u.PasswordImported = false
 	}
 
 	return err
@@ -71,13 +97,16 @@ func (u *User) PasswordsMatch(plainPassword string) bool {
 
 // Validate checks if the User struct is valid or not.
 func (u *User) Validate() error {
+	if err := validUsername(u.Username); err != nil {
+		return err
+	}
 	if u.Password == "" {
 		return ErrNoPassword
 	}
-	if !IsHashedPass(u.Password) {
+	if !IsHashedPass(u.Password) && !(u.PasswordImported && IsSupportedHash(u.Password)) {
 		return ErrPlainPassword
 	}
-	if u.Status < StatusActive {
+	if u.Status < StatusActive || u.Status > StatusDeleted {
 		return ErrBadStatus
 	}
 	return nil
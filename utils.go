@@ -20,8 +20,35 @@ const (
 	ErrUserExists    = errors.Error("user already exists")
 	ErrUserNotFound  = errors.Error("user not found")
 	ErrBadStatus     = errors.Error("bad status")
+	ErrBadTransition = errors.Error("status transition not allowed")
 	ErrNewUserWithID = errors.Error("a new user can't have an id set")
 	ErrPlainPassword = errors.Error("plain password")
+	ErrProfileType   = errors.Error("profile type mismatch")
+	ErrSchemaVersion = errors.Error("user schema version is newer than supported")
+	ErrImportVersion = errors.Error("unsupported import format")
+	ErrInvalidImport = errors.Error("invalid import")
+	ErrRecordExists  = errors.Error("record already exists")
+
+	ErrUnsupportedHash = errors.Error("unsupported password hash")
+	ErrWrongKey        = errors.Error("the store is not encrypted with the provided key")
+	ErrNoFieldKey      = errors.Error("field encryption is not enabled")
+	ErrEncryptedField  = errors.Error("only string profile fields can be encrypted")
+	ErrDecrypt         = errors.Error("decryption failed")
+	ErrAuditDisabled   = errors.Error("the audit log is not enabled")
+	ErrAuditTampered   = errors.Error("the audit log was tampered with")
+	ErrOutboxDisabled  = errors.Error("the outbox is not enabled")
+	ErrAccountExpired  = errors.Error("account expired")
+	ErrPasswordExpired = errors.Error("password expired, a password change is required")
+	ErrPasswordReused  = errors.Error("password was used recently")
+	ErrImpersonation   = errors.Error("impersonation not allowed")
+	ErrImpersonating   = errors.Error("credentials can't be changed while impersonating")
+	ErrInvalidTenant   = errors.Error("invalid tenant id")
+	ErrTenantChange    = errors.Error("the tenant of a user can't be changed")
+	ErrInvalidUsername = errors.Error("invalid username")
+	ErrInviteNotFound  = errors.Error("invite code not found")
+	ErrInviteExpired   = errors.Error("invite code expired")
+	ErrInviteUsedUp    = errors.Error("invite code has no uses left")
+	ErrInviteRevoked   = errors.Error("invite code revoked")
 )
 
 // marshalUser is used by turtle for marshaling users
@@ -52,6 +79,11 @@ func marshalUser(v turtleDB.Value) ([]byte, error) {
 
 // EditUserTx is a helper func for Auth.EditUser.
 func EditUserTx(tx turtleDB.Txn, id string, fn func(u *User) error) (err error) {
+	return editUserRecordTx(tx, id, fn, false)
+}
+
+// editUserRecordTx is EditUserTx, imported is true when fn sets a password hash from an importer.
+func editUserRecordTx(tx turtleDB.Txn, id string, fn func(u *User) error, imported bool) (err error) {
 	var (
 		usersB, _  = tx.Get("users")
 		loginsB, _ = tx.Get("logins")
@@ -69,22 +101,31 @@ func EditUserTx(tx turtleDB.Txn, id string, fn func(u *User) error) (err error)
 	}
 
 	// allow changing username
-	oldUser := u.Username
+	oldUser, tenant, oldPassword := u.Username, u.TenantID, u.Password
 	if err = fn(&u); err != nil {
 		return
 	}
 
+	if u.Password != oldPassword {
+		// only the importers store foreign hashes, a new password from anywhere else must be bcrypt
+		u.PasswordImported = imported
+	}
+
+	if u.TenantID != tenant {
+		return ErrTenantChange
+	}
+
 	if err = u.Validate(); err != nil {
 		return
 	}
 
 	if oldUser != u.Username { // username change
-		if oid, _ := GetUserIDTx(tx, u.Username); oid != "" {
+		if oid, _ := GetUserIDTx(tx, loginKey(u.TenantID, u.Username)); oid != "" {
 			return ErrUserExists
 		}
 
-		loginsB.Delete(oldUser)
-		loginsB.Put(u.Username, u.ID)
+		loginsB.Delete(loginKey(u.TenantID, oldUser))
+		loginsB.Put(loginKey(u.TenantID, u.Username), u.ID)
 	}
 
 	return usersB.Put(u.ID, u)
@@ -116,7 +157,8 @@ func GetUserByIDTx(tx turtleDB.Txn, id string) (usr User, err error) {
 	}
 }
 
-// GetUserByNameTx is a helper func for Auth.GetUserByName.
+// GetUserByNameTx is a helper func for Auth.GetUserByName, username is the key of the logins bucket
+// so unlike Auth.GetUserByName it isn't checked.
 func GetUserByNameTx(tx turtleDB.Txn, username string) (usr User, err error) {
 	var id string
 	if id, err = GetUserIDTx(tx, username); err != nil {